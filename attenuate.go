@@ -0,0 +1,189 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// attenuateRequest is the JSON request body accepted by the attenuate
+// endpoint.
+type attenuateRequest struct {
+	Macaroons macaroon.Slice `json:"macaroons"`
+	Caveats   []string       `json:"caveats"`
+}
+
+// operations are the operation names which may be given in an "operation"
+// caveat, along with the name of the path parameter identifying what each
+// operates upon, if any.
+var operations = map[string]string{
+	"fetch":     "object",
+	"delete":    "object",
+	"list":      "collection",
+	"add":       "collection",
+	"create":    "",
+	"inventory": "",
+}
+
+// caveatValidators check the arguments of the first-party caveat conditions
+// understood by newCheckers, keyed by condition. They only check that a
+// caveat is well-formed, not whether it would be satisfied by any
+// particular request.
+var caveatValidators = map[string]func(arg string) error{
+	"time-before": func(arg string) error {
+		_, err := time.Parse(time.RFC3339, arg)
+		return err
+	},
+	condTimeAfter: func(arg string) error {
+		_, err := time.Parse(time.RFC3339, arg)
+		return err
+	},
+	condTimeWindow: func(arg string) error {
+		_, err := ParseTimeWindow(arg)
+		return err
+	},
+	"client-ip-addr": func(arg string) error {
+		if net.ParseIP(arg) == nil {
+			return fmt.Errorf("invalid IP address %q", arg)
+		}
+		return nil
+	},
+	condClientIPCIDR: func(arg string) error {
+		_, err := parseCIDRs(arg)
+		return err
+	},
+	condClientCertSHA256: func(arg string) error {
+		_, err := parseCertFingerprint(arg)
+		return err
+	},
+	condHolderKey: func(arg string) error {
+		_, err := parseHolderKey(arg)
+		return err
+	},
+	condOrigin: func(arg string) error {
+		_, err := parseOrigins(arg)
+		return err
+	},
+	condRefererPrefix: validateRefererPrefix,
+	condContentType: func(arg string) error {
+		_, err := parseMediaRanges(arg)
+		return err
+	},
+	condHeader: func(arg string) error {
+		_, _, err := parseHeaderCaveat(arg)
+		return err
+	},
+	condOperation: func(arg string) error {
+		for _, op := range strings.Split(arg, ",") {
+			op = strings.TrimSpace(strings.ToLower(op))
+			if _, ok := operations[op]; !ok {
+				return fmt.Errorf("unknown operation %q", op)
+			}
+		}
+		return nil
+	},
+	condRateLimit: func(arg string) error {
+		_, err := ParseRateLimit(arg)
+		return err
+	},
+	condObject: func(arg string) error {
+		if arg == "" {
+			return fmt.Errorf("missing object ID")
+		}
+		return nil
+	},
+	condCollection: func(arg string) error {
+		if arg == "" {
+			return fmt.Errorf("missing collection ID")
+		}
+		return nil
+	},
+}
+
+// validateCaveat returns an error if the given first-party caveat is not
+// one that this service knows how to check.
+func validateCaveat(cav string) error {
+	cond, arg, err := checkers.ParseCaveat(cav)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	validate, ok := caveatValidators[cond]
+	if !ok {
+		return errgo.Newf("caveat condition %q not recognized", cond)
+	}
+	err = validate(arg)
+	if err != nil {
+		return errgo.Notef(err, "invalid caveat %q", cav)
+	}
+	return nil
+}
+
+// attenuate handles the request to add first-party caveats to a macaroon,
+// responding with the restricted macaroon. This allows clients without a
+// macaroon library to narrow the authorization of a macaroon before sharing
+// it with others.
+func (s *Service) attenuate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req attenuateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpErrorf(w, http.StatusBadRequest, errgo.Notef(err, "invalid request"))
+		return
+	}
+	switch len(req.Macaroons) {
+	case 0:
+		httpErrorf(w, http.StatusBadRequest, errgo.New("no macaroon to attenuate"))
+		return
+	case 1:
+	default:
+		// Discharge macaroons are bound to the signature of the macaroon
+		// they discharge, which adding caveats would change.
+		httpErrorf(w, http.StatusBadRequest, errgo.New("cannot attenuate a macaroon with discharges"))
+		return
+	}
+	for _, cav := range req.Caveats {
+		err = validateCaveat(cav)
+		if err != nil {
+			httpErrorf(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	m := req.Macaroons[0]
+	for _, cav := range req.Caveats {
+		err = s.bakery.AddCaveat(m, checkers.Caveat{Condition: cav})
+		if err != nil {
+			httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to add caveat"))
+			return
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(macaroon.Slice{m})
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+)
+
+// AuditRecord records the authorization decision made for a request to
+// create, fetch or delete an object.
+type AuditRecord struct {
+	// Time is when the request was received.
+	Time time.Time `json:"time"`
+
+	// Operation is the operation requested: create, fetch or delete.
+	Operation string `json:"operation"`
+
+	// Object is the ID of the object operated upon. For create, this is
+	// the ID of the new object.
+	Object string `json:"object,omitempty"`
+
+	// MacaroonID is the identifier of the macaroon presented, if any. When
+	// creating an object, this is the owner macaroon.
+	MacaroonID string `json:"macaroon-id,omitempty"`
+
+	// IssuedFor is the first caveat of the macaroon presented, which names
+	// the object, collection or owner it was issued for. Macaroons issued
+	// with a RootKeyStore share their root key's identifier, so this tells
+	// them apart.
+	IssuedFor string `json:"issued-for,omitempty"`
+
+	// ClientAddr is the address of the client making the request.
+	ClientAddr string `json:"client-addr"`
+
+	// Caveats are the first-party caveats evaluated, in the order they
+	// were checked, except that object keys are omitted.
+	Caveats []string `json:"caveats"`
+
+	// Allowed reports whether the request was authorized.
+	Allowed bool `json:"allowed"`
+
+	// Reason is why the request was refused, if it was.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditSink records authorization decisions.
+type AuditSink interface {
+	// Record records the given decision.
+	Record(rec *AuditRecord) error
+}
+
+type jsonAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditSink returns an AuditSink which writes each record to w as a
+// line of JSON.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{enc: json.NewEncoder(w)}
+}
+
+// Record implements AuditSink.
+func (s *jsonAuditSink) Record(rec *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errgo.Mask(s.enc.Encode(rec))
+}
+
+// newAuditRecord starts the audit record of a request for op upon object,
+// or returns nil if decisions are not audited.
+func (s *Service) newAuditRecord(r *http.Request, op, object string) *AuditRecord {
+	if s.audit == nil {
+		return nil
+	}
+	return &AuditRecord{
+		Time:       time.Now().UTC(),
+		Operation:  op,
+		Object:     object,
+		ClientAddr: s.clientAddr(r),
+		Caveats:    []string{},
+	}
+}
+
+// recordAudit completes the audit record rec with the decision made, which
+// is to refuse the request if err is not nil, and records it. Failures are
+// only logged, so that a sink which is unavailable does not take the service
+// down with it.
+func (s *Service) recordAudit(rec *AuditRecord, err error) {
+	if rec == nil {
+		return
+	}
+	rec.Allowed = err == nil
+	if err != nil {
+		rec.Reason = err.Error()
+	}
+	err = s.audit.Record(rec)
+	if err != nil {
+		log.Printf("failed to record audit of %s %q: %s", rec.Operation, rec.Object, errgo.Details(err))
+	}
+}
+
+// auditChecker records the caveats checked by the checker it wraps.
+type auditChecker struct {
+	bakery.FirstPartyChecker
+	rec *AuditRecord
+}
+
+// CheckFirstPartyCaveat implements bakery.FirstPartyChecker.
+func (c auditChecker) CheckFirstPartyCaveat(cav string) error {
+	c.rec.Caveats = append(c.rec.Caveats, redactCaveat(cav))
+	return c.FirstPartyChecker.CheckFirstPartyCaveat(cav)
+}
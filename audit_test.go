@@ -0,0 +1,230 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// auditServiceSuite runs the service tests while auditing authorization
+// decisions.
+type auditServiceSuite struct {
+	serviceSuite
+	sink *memAuditSink
+}
+
+var _ = gc.Suite(&auditServiceSuite{})
+
+// memAuditSink keeps audit records in memory.
+type memAuditSink struct {
+	mu   sync.Mutex
+	recs []oostore.AuditRecord
+}
+
+func (s *memAuditSink) Record(rec *oostore.AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recs = append(s.recs, *rec)
+	return nil
+}
+
+func (s *memAuditSink) records() []oostore.AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]oostore.AuditRecord(nil), s.recs...)
+}
+
+func (s *auditServiceSuite) SetUpTest(c *gc.C) {
+	s.sink = &memAuditSink{}
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		AuditSink:   s.sink,
+	})
+}
+
+func (s *auditServiceSuite) TestAudit(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	id := path.Base(loc)
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	var ms macaroon.Slice
+	c.Assert(json.Unmarshal(auth, &ms), gc.IsNil)
+
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	req, err := http.NewRequest("DELETE", s.server.URL+loc, bytes.NewBuffer(withCaveat(c, auth, "operation fetch")))
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBufferString("nope"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+
+	recs := s.sink.records()
+	c.Assert(recs, gc.HasLen, 4)
+	for i, rec := range recs {
+		c.Assert(rec.Object, gc.Equals, id, gc.Commentf("record #%d", i))
+		c.Assert(rec.ClientAddr, gc.Equals, "127.0.0.1", gc.Commentf("record #%d", i))
+		c.Assert(time.Since(rec.Time) < time.Minute, gc.Equals, true, gc.Commentf("record #%d", i))
+	}
+	c.Assert(recs[0].Operation, gc.Equals, "create")
+	c.Assert(recs[0].Allowed, gc.Equals, true)
+	c.Assert(recs[0].MacaroonID, gc.Equals, "")
+	c.Assert(recs[0].Caveats, gc.HasLen, 0)
+
+	c.Assert(recs[1].Operation, gc.Equals, "fetch")
+	c.Assert(recs[1].Allowed, gc.Equals, true)
+	c.Assert(recs[1].MacaroonID, gc.Equals, ms[0].Id())
+	c.Assert(recs[1].IssuedFor, gc.Equals, "object "+id)
+	c.Assert(recs[1].Caveats, gc.DeepEquals, []string{"object " + id})
+	c.Assert(recs[1].Reason, gc.Equals, "")
+
+	c.Assert(recs[2].Operation, gc.Equals, "delete")
+	c.Assert(recs[2].Allowed, gc.Equals, false)
+	c.Assert(recs[2].MacaroonID, gc.Equals, ms[0].Id())
+	c.Assert(recs[2].Caveats, gc.DeepEquals, []string{"object " + id, "operation fetch"})
+	c.Assert(recs[2].Reason, gc.Matches, `.*operation "delete" not allowed.*`)
+
+	c.Assert(recs[3].Operation, gc.Equals, "fetch")
+	c.Assert(recs[3].Allowed, gc.Equals, false)
+	c.Assert(recs[3].MacaroonID, gc.Equals, "")
+	c.Assert(recs[3].Reason, gc.Not(gc.Equals), "")
+}
+
+func (s *auditServiceSuite) TestAuditObjectKey(c *gc.C) {
+	s.server.Close()
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		ObjectKeys:  true,
+		AuditSink:   s.sink,
+	})
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	// The object key is not recorded.
+	recs := s.sink.records()
+	c.Assert(recs, gc.HasLen, 2)
+	c.Assert(recs[1].Allowed, gc.Equals, true)
+	c.Assert(recs[1].Caveats, gc.DeepEquals, []string{"object " + path.Base(loc), "object-key"})
+}
+
+func (s *auditServiceSuite) TestAuditFailures(c *gc.C) {
+	s.server.Close()
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		Limits:      oostore.Limits{Quota: 10},
+		AuditSink:   s.sink,
+	})
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	resp, err = cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+
+	req, err := http.NewRequest("DELETE", s.server.URL+loc, bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent)
+
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+
+	recs := s.sink.records()
+	c.Assert(recs, gc.HasLen, 4)
+	c.Assert(recs[0].Operation, gc.Equals, "create")
+	c.Assert(recs[0].Allowed, gc.Equals, true)
+	c.Assert(recs[1].Operation, gc.Equals, "create")
+	c.Assert(recs[1].Allowed, gc.Equals, false)
+	c.Assert(recs[1].Reason, gc.Equals, "storage quota exceeded")
+	c.Assert(recs[2].Operation, gc.Equals, "delete")
+	c.Assert(recs[2].Allowed, gc.Equals, true)
+	c.Assert(recs[3].Operation, gc.Equals, "fetch")
+	c.Assert(recs[3].Allowed, gc.Equals, false)
+	c.Assert(recs[3].Reason, gc.Matches, "not found: .*")
+}
+
+func (s *auditServiceSuite) TestJSONAuditSink(c *gc.C) {
+	var buf bytes.Buffer
+	sink := oostore.NewJSONAuditSink(&buf)
+	t := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	c.Assert(sink.Record(&oostore.AuditRecord{
+		Time:       t,
+		Operation:  "fetch",
+		Object:     "foo",
+		MacaroonID: "bar",
+		ClientAddr: "127.0.0.1",
+		Caveats:    []string{"object foo"},
+		Allowed:    true,
+	}), gc.IsNil)
+	c.Assert(sink.Record(&oostore.AuditRecord{
+		Time:       t,
+		Operation:  "delete",
+		Object:     "foo",
+		ClientAddr: "127.0.0.1",
+		Caveats:    []string{},
+		Reason:     "no macaroons",
+	}), gc.IsNil)
+	c.Assert(buf.String(), gc.Equals,
+		`{"time":"2015-10-21T07:28:00Z","operation":"fetch","object":"foo","macaroon-id":"bar","client-addr":"127.0.0.1","caveats":["object foo"],"allowed":true}`+"\n"+
+			`{"time":"2015-10-21T07:28:00Z","operation":"delete","object":"foo","client-addr":"127.0.0.1","caveats":[],"allowed":false,"reason":"no macaroons"}`+"\n")
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// condClientIPCIDR is the condition of caveats which restrict the client
+// address to any of a comma-separated list of networks.
+const condClientIPCIDR = "client-ip-cidr"
+
+// clientAddr returns the IP address of the client making the request. If the
+// request comes from a trusted proxy, the address is taken from the
+// addresses the proxy says it forwarded the request for, starting with the
+// one nearest to the service, and passing over any which are trusted
+// proxies themselves.
+func (s *Service) clientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if len(s.proxies) == 0 {
+		return addr
+	}
+	forwarded := forwardedAddrs(r)
+	for i := len(forwarded) - 1; i >= 0 && s.trustedProxy(addr); i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			// Obfuscated or unknown addresses can't be traced any
+			// further.
+			break
+		}
+		addr = ip.String()
+	}
+	return addr
+}
+
+// clientRequest returns the request with its remote address replaced by
+// the address of the client it was forwarded for, if it comes from a trusted
+// proxy, so that checkers of the request see the client.
+func (s *Service) clientRequest(r *http.Request) *http.Request {
+	if len(s.proxies) == 0 {
+		return r
+	}
+	r1 := *r
+	r1.RemoteAddr = net.JoinHostPort(s.clientAddr(r), "0")
+	return &r1
+}
+
+func (s *Service) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedAddrs returns the addresses of the clients and proxies a request
+// was forwarded for, from the client onwards, as given in the Forwarded
+// header, or in X-Forwarded-For if there is none.
+func forwardedAddrs(r *http.Request) []string {
+	var addrs []string
+	if fields := r.Header["Forwarded"]; len(fields) > 0 {
+		for _, elem := range strings.Split(strings.Join(fields, ","), ",") {
+			var addr string
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.ToLower(kv[0]) == "for" {
+					addr = forwardedNode(kv[1])
+				}
+			}
+			addrs = append(addrs, addr)
+		}
+		return addrs
+	}
+	for _, field := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(field, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	return addrs
+}
+
+// forwardedNode returns the address of a node given in a Forwarded header,
+// without quotes, brackets or port.
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// parseCIDRs parses a comma-separated list of networks.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", strings.TrimSpace(cidr))
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIPCIDRChecker checks that the client making the request has an
+// address within one of the networks given in a client-ip-cidr caveat.
+func (s *Service) clientIPCIDRChecker(r *http.Request) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condClientIPCIDR,
+		Check_: func(_, cav string) error {
+			nets, err := parseCIDRs(cav)
+			if err != nil {
+				return err
+			}
+			addr := s.clientAddr(r)
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return fmt.Errorf("cannot parse client IP address %q", addr)
+			}
+			for _, n := range nets {
+				if n.Contains(ip) {
+					return nil
+				}
+			}
+			return fmt.Errorf("client IP address %s not allowed", addr)
+		},
+	}
+}
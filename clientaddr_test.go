@@ -0,0 +1,116 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// proxyServiceSuite tests a service behind a trusted proxy. It does not run
+// the other service tests, which expect forwarded addresses to be ignored.
+type proxyServiceSuite struct {
+	svc serviceSuite
+}
+
+var _ = gc.Suite(&proxyServiceSuite{})
+
+func (s *proxyServiceSuite) SetUpTest(c *gc.C) {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	c.Assert(err, gc.IsNil)
+	s.svc.setUpService(c, oostore.ServiceConfig{
+		ObjectStore:    oostore.NewMemStorage(),
+		TrustedProxies: []*net.IPNet{loopback},
+	})
+}
+
+func (s *proxyServiceSuite) TearDownTest(c *gc.C) {
+	s.svc.TearDownTest(c)
+}
+
+func (s *proxyServiceSuite) TestForwarded(c *gc.C) {
+	resp, err := http.Post(s.svc.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for i, testCase := range []struct {
+		desc       string
+		header     http.Header
+		statusCode int
+	}{{
+		desc:       "not forwarded",
+		statusCode: http.StatusForbidden,
+	}, {
+		desc:       "forwarded for client",
+		header:     http.Header{"X-Forwarded-For": {"10.1.2.3"}},
+		statusCode: http.StatusOK,
+	}, {
+		desc:       "forwarded by trusted proxies",
+		header:     http.Header{"X-Forwarded-For": {"10.1.2.3, 127.0.0.5", "127.0.0.6"}},
+		statusCode: http.StatusOK,
+	}, {
+		desc:       "forwarded by untrusted proxy",
+		header:     http.Header{"X-Forwarded-For": {"10.1.2.3, 192.168.1.1"}},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc:       "spoofed by client",
+		header:     http.Header{"X-Forwarded-For": {"10.1.2.3, 192.168.1.1, 10.1.2.3"}},
+		statusCode: http.StatusOK,
+	}, {
+		desc:       "forwarded header",
+		header:     http.Header{"Forwarded": {"for=10.1.2.3;proto=https"}},
+		statusCode: http.StatusOK,
+	}, {
+		desc:       "forwarded header with IPv6 and port",
+		header:     http.Header{"Forwarded": {`for="[2001:db8::1]:4711", for=10.1.2.3`}},
+		statusCode: http.StatusOK,
+	}, {
+		desc:       "unknown client",
+		header:     http.Header{"Forwarded": {"for=unknown"}},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "forwarded header takes precedence",
+		header: http.Header{
+			"Forwarded":       {"for=192.168.1.1"},
+			"X-Forwarded-For": {"10.1.2.3"},
+		},
+		statusCode: http.StatusForbidden,
+	}} {
+		for _, cav := range []string{"client-ip-cidr 10.0.0.0/8", "client-ip-addr 10.1.2.3"} {
+			comment := gc.Commentf("test#%d: %s: %s", i, testCase.desc, cav)
+			req, err := http.NewRequest("POST", s.svc.server.URL+loc, bytes.NewBuffer(withCaveat(c, auth, cav)))
+			c.Assert(err, gc.IsNil, comment)
+			for k, v := range testCase.header {
+				req.Header[k] = v
+			}
+			resp, err := http.DefaultClient.Do(req)
+			c.Assert(err, gc.IsNil, comment)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// condClientCertSHA256 is the condition of caveats which bind a macaroon to
+// the TLS client certificate with the given SHA-256 fingerprint.
+const condClientCertSHA256 = "client-cert-sha256"
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate, as
+// given in client-cert-sha256 caveats.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseCertFingerprint parses a SHA-256 certificate fingerprint in
+// hexadecimal, optionally with colons between the bytes.
+func parseCertFingerprint(s string) ([]byte, error) {
+	fp, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return fp, nil
+}
+
+// clientCertChecker checks that the request was made over a TLS connection
+// on which the client presented the certificate given in a
+// client-cert-sha256 caveat.
+func clientCertChecker(r *http.Request) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condClientCertSHA256,
+		Check_: func(_, cav string) error {
+			fp, err := parseCertFingerprint(cav)
+			if err != nil {
+				return err
+			}
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				return fmt.Errorf("no client certificate")
+			}
+			sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], fp) {
+				return fmt.Errorf("client certificate mismatch")
+			}
+			return nil
+		},
+	}
+}
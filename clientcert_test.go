@@ -0,0 +1,135 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// clientCertServiceSuite tests a service served over TLS, to clients which
+// present certificates.
+type clientCertServiceSuite struct {
+	svc    serviceSuite
+	client *http.Client
+	cert   *x509.Certificate
+}
+
+var _ = gc.Suite(&clientCertServiceSuite{})
+
+func (s *clientCertServiceSuite) SetUpTest(c *gc.C) {
+	s.svc.setUpService(c, oostore.ServiceConfig{ObjectStore: oostore.NewMemStorage()})
+	s.svc.server.Close()
+	s.svc.server = httptest.NewUnstartedServer(s.svc.service)
+	s.svc.server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.svc.server.StartTLS()
+
+	var cert tls.Certificate
+	cert, s.cert = newClientCert(c)
+	transport := s.svc.server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	s.client = &http.Client{Transport: transport}
+}
+
+func (s *clientCertServiceSuite) TearDownTest(c *gc.C) {
+	s.svc.TearDownTest(c)
+}
+
+// newClientCert returns a new self-signed client certificate.
+func newClientCert(c *gc.C) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, gc.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, gc.IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func (s *clientCertServiceSuite) TestClientCert(c *gc.C) {
+	resp, err := s.client.Post(s.svc.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	fp := oostore.CertFingerprint(s.cert)
+	_, other := newClientCert(c)
+	var colons []string
+	for i := 0; i < len(fp); i += 2 {
+		colons = append(colons, strings.ToUpper(fp[i:i+2]))
+	}
+	noCert := s.svc.server.Client()
+	for i, testCase := range []struct {
+		desc        string
+		client      *http.Client
+		fingerprint string
+		statusCode  int
+	}{{
+		desc:        "matching certificate",
+		client:      s.client,
+		fingerprint: fp,
+		statusCode:  http.StatusOK,
+	}, {
+		desc:        "matching certificate with colons",
+		client:      s.client,
+		fingerprint: strings.Join(colons, ":"),
+		statusCode:  http.StatusOK,
+	}, {
+		desc:        "other certificate",
+		client:      s.client,
+		fingerprint: oostore.CertFingerprint(other),
+		statusCode:  http.StatusForbidden,
+	}, {
+		desc:        "no certificate",
+		client:      noCert,
+		fingerprint: fp,
+		statusCode:  http.StatusForbidden,
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.desc)
+		resp, err := testCase.client.Post(s.svc.server.URL+loc, "application/json",
+			bytes.NewBuffer(withCaveat(c, auth, "client-cert-sha256 "+testCase.fingerprint)))
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+	}
+}
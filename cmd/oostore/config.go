@@ -0,0 +1,402 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/cmars/oostore"
+)
+
+const defaultDatabase = "host=/var/run/postgresql database=oostore"
+
+const defaultMaxObjectSize = 16 << 20
+
+// Storage backends.
+const (
+	backendPostgres = "postgres"
+	backendMemory   = "memory"
+)
+
+// config is the server configuration, as read from a YAML configuration
+// file and overridden by command line flags.
+type config struct {
+	HTTP            string                     `yaml:"http"`
+	HTTPS           string                     `yaml:"https"`
+	TLS             tlsConfig                  `yaml:"tls"`
+	Prefix          string                     `yaml:"prefix"`
+	TrustedProxies  []string                   `yaml:"trusted-proxies"`
+	CORS            bool                       `yaml:"cors"`
+	Database        string                     `yaml:"database"`
+	Storage         storeConfig                `yaml:"storage"`
+	Limits          limitsConfig               `yaml:"limits"`
+	RateLimits      map[string]rateLimitConfig `yaml:"rate-limits"`
+	RootKeys        rootKeyConfig              `yaml:"root-keys"`
+	GC              gcConfig                   `yaml:"gc"`
+	Metrics         string                     `yaml:"metrics"`
+	Audit           auditConfig                `yaml:"audit"`
+	Log             logConfig                  `yaml:"log"`
+	ShutdownTimeout time.Duration              `yaml:"shutdown-timeout"`
+}
+
+// tlsConfig locates the TLS certificate and private key for HTTPS, and
+// says whether clients are asked for certificates of their own.
+type tlsConfig struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	ClientAuth string `yaml:"client-auth"`
+	ClientCA   string `yaml:"client-ca"`
+}
+
+// clientAuthTypes are the policies for TLS client certificates, by name.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// storeConfig describes how objects are stored.
+type storeConfig struct {
+	Backend         string `yaml:"backend"`
+	Dedup           bool   `yaml:"dedup"`
+	Compress        bool   `yaml:"compress"`
+	CompressMinSize int    `yaml:"compress-min-size"`
+	ObjectKeys      bool   `yaml:"object-keys"`
+	MasterKeys      string `yaml:"master-keys"`
+}
+
+// limitsConfig restricts object sizes and how much may be stored, in
+// bytes. Zero values are unlimited.
+type limitsConfig struct {
+	MaxObjectSize int64 `yaml:"max-object-size"`
+	Quota         int64 `yaml:"quota"`
+	OwnerQuota    int64 `yaml:"owner-quota"`
+}
+
+// rateLimitConfig limits the requests made to a route, in the form
+// "N/duration".
+type rateLimitConfig struct {
+	Client   string `yaml:"client"`
+	Macaroon string `yaml:"macaroon"`
+}
+
+// rootKeyConfig describes how macaroon root keys are rotated.
+type rootKeyConfig struct {
+	Expiry   time.Duration `yaml:"expiry"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// gcConfig describes how garbage is collected.
+type gcConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Grace    time.Duration `yaml:"grace"`
+}
+
+// auditConfig describes where authorization decisions are recorded.
+type auditConfig struct {
+	Log string `yaml:"log"`
+	DB  bool   `yaml:"db"`
+}
+
+// logConfig describes where the server logs to.
+type logConfig struct {
+	File string `yaml:"file"`
+}
+
+// defaultConfig returns the configuration used for anything not set by a
+// configuration file or flags.
+func defaultConfig() *config {
+	return &config{
+		HTTP:     defaultHTTP,
+		TLS:      tlsConfig{ClientAuth: "none"},
+		Prefix:   "/",
+		Database: defaultDatabase,
+		Storage: storeConfig{
+			Backend:         backendPostgres,
+			CompressMinSize: oostore.DefaultCompressMinSize,
+		},
+		Limits: limitsConfig{
+			MaxObjectSize: defaultMaxObjectSize,
+		},
+		RootKeys: rootKeyConfig{
+			Interval: 24 * time.Hour,
+		},
+		GC: gcConfig{
+			Grace: time.Hour,
+		},
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// readConfig reads the configuration file at path over the defaults. Fields
+// not known to the server are reported as errors, so that mistakes are not
+// silently ignored.
+func readConfig(path string) (*config, error) {
+	cfg := defaultConfig()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = yaml.UnmarshalStrict(buf, cfg)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid configuration file %q", path)
+	}
+	return cfg, nil
+}
+
+// loadConfig returns the configuration given by the --config file, if any,
+// overridden by any other flags set on the command line, and validates it.
+func loadConfig(c *cli.Context) (*config, error) {
+	cfg := defaultConfig()
+	if path := flagString(c, "config"); path != "" {
+		var err error
+		cfg, err = readConfig(path)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	cfg.applyFlags(c)
+	err := cfg.validate()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return cfg, nil
+}
+
+// applyFlags overrides the configuration with the flags set on the command
+// line, and the database connection string given as arguments.
+func (cfg *config) applyFlags(c *cli.Context) {
+	setString := func(name string, v *string) {
+		if isSet(c, name) {
+			*v = flagString(c, name)
+		}
+	}
+	// Boolean flags turn options off when given as --flag=false.
+	setBool := func(name string, v *bool) {
+		if c.IsSet(name) {
+			*v = c.Bool(name)
+		} else if c.GlobalIsSet(name) {
+			*v = c.GlobalBool(name)
+		}
+	}
+	setInt64 := func(name string, v *int64) {
+		if c.IsSet(name) {
+			*v = c.Int64(name)
+		} else if c.GlobalIsSet(name) {
+			*v = c.GlobalInt64(name)
+		}
+	}
+	setDuration := func(name string, v *time.Duration) {
+		if c.IsSet(name) {
+			*v = c.Duration(name)
+		} else if c.GlobalIsSet(name) {
+			*v = c.GlobalDuration(name)
+		}
+	}
+	setString("http", &cfg.HTTP)
+	setString("https", &cfg.HTTPS)
+	setString("cert", &cfg.TLS.Cert)
+	setString("key", &cfg.TLS.Key)
+	setString("client-auth", &cfg.TLS.ClientAuth)
+	setString("client-ca", &cfg.TLS.ClientCA)
+	setString("prefix", &cfg.Prefix)
+	if isSet(c, "trusted-proxies") {
+		cfg.TrustedProxies = strings.Split(flagString(c, "trusted-proxies"), ",")
+	}
+	setBool("cors", &cfg.CORS)
+	setString("backend", &cfg.Storage.Backend)
+	setBool("dedup", &cfg.Storage.Dedup)
+	setBool("compress", &cfg.Storage.Compress)
+	if c.IsSet("compress-min-size") {
+		cfg.Storage.CompressMinSize = c.Int("compress-min-size")
+	} else if c.GlobalIsSet("compress-min-size") {
+		cfg.Storage.CompressMinSize = c.GlobalInt("compress-min-size")
+	}
+	setBool("object-keys", &cfg.Storage.ObjectKeys)
+	setString("master-keys", &cfg.Storage.MasterKeys)
+	setInt64("max-object-size", &cfg.Limits.MaxObjectSize)
+	setInt64("quota", &cfg.Limits.Quota)
+	setInt64("owner-quota", &cfg.Limits.OwnerQuota)
+	setDuration("root-key-expiry", &cfg.RootKeys.Expiry)
+	setDuration("root-key-interval", &cfg.RootKeys.Interval)
+	setDuration("gc-interval", &cfg.GC.Interval)
+	setDuration("gc-grace", &cfg.GC.Grace)
+	setString("metrics", &cfg.Metrics)
+	setString("audit-log", &cfg.Audit.Log)
+	setBool("audit-db", &cfg.Audit.DB)
+	setString("log-file", &cfg.Log.File)
+	setDuration("shutdown-timeout", &cfg.ShutdownTimeout)
+	if args := c.Args(); len(args) > 0 {
+		cfg.Database = strings.Join(args, " ")
+	}
+}
+
+// validate returns an error describing the first problem found with the
+// configuration, if any.
+func (cfg *config) validate() error {
+	if cfg.HTTP == "" && cfg.HTTPS == "" {
+		return errgo.New("no HTTP or HTTPS listen address")
+	}
+	if cfg.HTTPS != "" {
+		if cfg.TLS.Cert == "" {
+			return errgo.New("HTTPS requires a TLS certificate")
+		}
+		if cfg.TLS.Key == "" {
+			return errgo.New("HTTPS requires a TLS private key")
+		}
+	}
+	clientAuth, ok := clientAuthTypes[cfg.TLS.ClientAuth]
+	if !ok {
+		return errgo.Newf("unknown client-auth %q", cfg.TLS.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && cfg.HTTPS == "" {
+		return errgo.New("client certificates require HTTPS")
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && cfg.TLS.ClientCA == "" {
+		return errgo.Newf("client-auth %s requires a client-ca", cfg.TLS.ClientAuth)
+	}
+	if !strings.HasPrefix(cfg.Prefix, "/") || !strings.HasSuffix(cfg.Prefix, "/") {
+		return errgo.Newf("prefix %q must begin and end with /", cfg.Prefix)
+	}
+	_, err := cfg.trustedProxies()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	switch cfg.Storage.Backend {
+	case backendPostgres:
+		if cfg.Database == "" {
+			return errgo.New("no database connection string")
+		}
+	case backendMemory:
+		if cfg.GC.Interval != 0 {
+			return errgo.New("garbage collection requires the postgres backend")
+		}
+		if cfg.Audit.DB {
+			return errgo.New("recording audit decisions in the database requires the postgres backend")
+		}
+	default:
+		return errgo.Newf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+	// Every object is encrypted under its own data key, so identical
+	// contents are never stored identically.
+	if cfg.Storage.Dedup && cfg.Storage.MasterKeys != "" {
+		return errgo.New("encryption at rest can't be combined with dedup")
+	}
+	if cfg.Storage.CompressMinSize < 0 {
+		return errgo.Newf("invalid compress-min-size %d", cfg.Storage.CompressMinSize)
+	}
+	if cfg.Limits.MaxObjectSize < 0 {
+		return errgo.Newf("invalid max-object-size %d", cfg.Limits.MaxObjectSize)
+	}
+	if cfg.Limits.Quota < 0 {
+		return errgo.Newf("invalid quota %d", cfg.Limits.Quota)
+	}
+	if cfg.Limits.OwnerQuota < 0 {
+		return errgo.Newf("invalid owner-quota %d", cfg.Limits.OwnerQuota)
+	}
+	_, err = cfg.rateLimits()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if cfg.RootKeys.Expiry < 0 {
+		return errgo.Newf("invalid root key expiry %v", cfg.RootKeys.Expiry)
+	}
+	if cfg.RootKeys.Expiry > 0 && cfg.RootKeys.Interval <= 0 {
+		return errgo.Newf("invalid root key interval %v", cfg.RootKeys.Interval)
+	}
+	if cfg.GC.Interval < 0 {
+		return errgo.Newf("invalid gc interval %v", cfg.GC.Interval)
+	}
+	if cfg.GC.Grace < 0 {
+		return errgo.Newf("invalid gc grace %v", cfg.GC.Grace)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return errgo.Newf("invalid shutdown timeout %v", cfg.ShutdownTimeout)
+	}
+	return nil
+}
+
+// trustedProxies returns the networks of trusted proxies. Addresses given
+// without a prefix length are taken as single hosts.
+func (cfg *config) trustedProxies() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range cfg.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errgo.Newf("invalid trusted proxy %q", proxy)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// rateLimits returns the rate limits of each route.
+func (cfg *config) rateLimits() (map[string]oostore.RouteRateLimits, error) {
+	limits := make(map[string]oostore.RouteRateLimits)
+	for route, rl := range cfg.RateLimits {
+		var limit oostore.RouteRateLimits
+		var err error
+		if rl.Client != "" {
+			limit.Client, err = oostore.ParseRateLimit(rl.Client)
+			if err != nil {
+				return nil, errgo.Notef(err, "route %q", route)
+			}
+		}
+		if rl.Macaroon != "" {
+			limit.Macaroon, err = oostore.ParseRateLimit(rl.Macaroon)
+			if err != nil {
+				return nil, errgo.Notef(err, "route %q", route)
+			}
+		}
+		limits[route] = limit
+	}
+	return limits, nil
+}
+
+// isSet returns whether the named flag was set on the command line, either
+// for the command or globally.
+func isSet(c *cli.Context, name string) bool {
+	return c.IsSet(name) || c.GlobalIsSet(name)
+}
+
+// flagString returns the value of the named string flag, set either for the
+// command or globally.
+func flagString(c *cli.Context, name string) string {
+	if c.IsSet(name) {
+		return c.String(name)
+	}
+	return c.GlobalString(name)
+}
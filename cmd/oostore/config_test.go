@@ -0,0 +1,281 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type configSuite struct{}
+
+var _ = gc.Suite(&configSuite{})
+
+// load returns the configuration loaded by the oostore command, or by its
+// gc subcommand if the arguments name it, when run with args.
+func (s *configSuite) load(c *gc.C, args ...string) (*config, error) {
+	var cfg *config
+	var err error
+	action := func(ctx *cli.Context) {
+		cfg, err = loadConfig(ctx)
+	}
+	app := cli.NewApp()
+	app.Flags = flags
+	app.Action = action
+	app.Commands = []cli.Command{{Name: "gc", Action: action}}
+	c.Assert(app.Run(append([]string{"oostore"}, args...)), gc.IsNil)
+	return cfg, err
+}
+
+func (s *configSuite) writeConfig(c *gc.C, contents string) string {
+	path := filepath.Join(c.MkDir(), "oostore.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(contents), 0600), gc.IsNil)
+	return path
+}
+
+func (s *configSuite) TestDefaults(c *gc.C) {
+	cfg, err := s.load(c)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg, gc.DeepEquals, defaultConfig())
+}
+
+func (s *configSuite) TestFile(c *gc.C) {
+	path := s.writeConfig(c, `
+http: ""
+https: :443
+tls:
+  cert: /etc/oostore/cert.pem
+  key: /etc/oostore/key.pem
+  client-auth: verify-if-given
+  client-ca: /etc/oostore/client-ca.pem
+prefix: /objects/
+trusted-proxies: [10.0.0.1, "fd00::/8"]
+cors: true
+database: host=db dbname=oostore
+storage:
+  compress: true
+  compress-min-size: 512
+  master-keys: /etc/oostore/master-keys
+limits:
+  max-object-size: 1048576
+  owner-quota: 104857600
+rate-limits:
+  fetch:
+    client: 10/1s
+    macaroon: 100/h
+root-keys:
+  expiry: 720h
+gc:
+  interval: 1h
+audit:
+  log: /var/log/oostore/audit.log
+log:
+  file: /var/log/oostore/oostore.log
+shutdown-timeout: 1m
+`)
+	cfg, err := s.load(c, "--config", path)
+	c.Assert(err, gc.IsNil)
+	expect := defaultConfig()
+	expect.HTTP = ""
+	expect.HTTPS = ":443"
+	expect.TLS = tlsConfig{
+		Cert:       "/etc/oostore/cert.pem",
+		Key:        "/etc/oostore/key.pem",
+		ClientAuth: "verify-if-given",
+		ClientCA:   "/etc/oostore/client-ca.pem",
+	}
+	expect.Prefix = "/objects/"
+	expect.TrustedProxies = []string{"10.0.0.1", "fd00::/8"}
+	expect.CORS = true
+	expect.Database = "host=db dbname=oostore"
+	expect.Storage.Compress = true
+	expect.Storage.CompressMinSize = 512
+	expect.Storage.MasterKeys = "/etc/oostore/master-keys"
+	expect.Limits.MaxObjectSize = 1 << 20
+	expect.Limits.OwnerQuota = 100 << 20
+	expect.RateLimits = map[string]rateLimitConfig{
+		"fetch": {Client: "10/1s", Macaroon: "100/h"},
+	}
+	expect.RootKeys.Expiry = 720 * time.Hour
+	expect.GC.Interval = time.Hour
+	expect.Audit.Log = "/var/log/oostore/audit.log"
+	expect.Log.File = "/var/log/oostore/oostore.log"
+	expect.ShutdownTimeout = time.Minute
+	c.Assert(cfg, gc.DeepEquals, expect)
+	proxies, err := cfg.trustedProxies()
+	c.Assert(err, gc.IsNil)
+	c.Assert(proxies, gc.HasLen, 2)
+	c.Assert(proxies[0].String(), gc.Equals, "10.0.0.1/32")
+	c.Assert(proxies[1].String(), gc.Equals, "fd00::/8")
+	limits, err := cfg.rateLimits()
+	c.Assert(err, gc.IsNil)
+	c.Assert(limits, gc.DeepEquals, map[string]oostore.RouteRateLimits{
+		"fetch": {
+			Client:   oostore.RateLimit{Requests: 10, Per: time.Second},
+			Macaroon: oostore.RateLimit{Requests: 100, Per: time.Hour},
+		},
+	})
+}
+
+func (s *configSuite) TestFlagsOverride(c *gc.C) {
+	path := s.writeConfig(c, `
+http: 127.0.0.1:8080
+prefix: /objects/
+database: host=db dbname=oostore
+storage:
+  compress-min-size: 512
+limits:
+  quota: 1024
+gc:
+  grace: 2h
+`)
+	cfg, err := s.load(c, "--config", path,
+		"--http", ":9090", "--trusted-proxies", "10.0.0.0/8,::1", "--cors", "--dedup", "--compress-min-size", "0", "--quota", "0", "--gc-grace", "1m",
+		"host=other", "dbname=oostore")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg.HTTP, gc.Equals, ":9090")
+	c.Assert(cfg.Prefix, gc.Equals, "/objects/")
+	c.Assert(cfg.TrustedProxies, gc.DeepEquals, []string{"10.0.0.0/8", "::1"})
+	c.Assert(cfg.CORS, gc.Equals, true)
+	c.Assert(cfg.Database, gc.Equals, "host=other dbname=oostore")
+	c.Assert(cfg.Storage.Dedup, gc.Equals, true)
+	c.Assert(cfg.Storage.CompressMinSize, gc.Equals, 0)
+	c.Assert(cfg.Limits.Quota, gc.Equals, int64(0))
+	c.Assert(cfg.GC.Grace, gc.Equals, time.Minute)
+
+	// Global flags apply to subcommands too.
+	cfg, err = s.load(c, "--config", path, "--gc-grace", "1m", "--dedup", "gc")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg.HTTP, gc.Equals, "127.0.0.1:8080")
+	c.Assert(cfg.Storage.Dedup, gc.Equals, true)
+	c.Assert(cfg.GC.Grace, gc.Equals, time.Minute)
+}
+
+func (s *configSuite) TestBoolFlagsOverride(c *gc.C) {
+	path := s.writeConfig(c, `
+cors: true
+storage:
+  dedup: true
+  compress: true
+audit:
+  db: true
+`)
+	cfg, err := s.load(c, "--config", path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg.CORS, gc.Equals, true)
+	c.Assert(cfg.Storage.Dedup, gc.Equals, true)
+	c.Assert(cfg.Storage.Compress, gc.Equals, true)
+	c.Assert(cfg.Audit.DB, gc.Equals, true)
+
+	cfg, err = s.load(c, "--config", path, "--cors=false", "--dedup=false", "--compress=false", "--audit-db=false")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg.CORS, gc.Equals, false)
+	c.Assert(cfg.Storage.Dedup, gc.Equals, false)
+	c.Assert(cfg.Storage.Compress, gc.Equals, false)
+	c.Assert(cfg.Audit.DB, gc.Equals, false)
+
+	// Subcommands see global flags turning options off too.
+	cfg, err = s.load(c, "--config", path, "--dedup=false", "gc")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cfg.Storage.Dedup, gc.Equals, false)
+	c.Assert(cfg.CORS, gc.Equals, true)
+}
+
+func (s *configSuite) TestInvalid(c *gc.C) {
+	for i, test := range []struct {
+		config string
+		args   []string
+		err    string
+	}{{
+		config: "htttp: :8080\n",
+		err:    `(?s)invalid configuration file .*field htttp not found.*`,
+	}, {
+		config: "gc:\n  interval: often\n",
+		err:    `(?s)invalid configuration file .*`,
+	}, {
+		config: "http: \"\"\n",
+		err:    "no HTTP or HTTPS listen address",
+	}, {
+		config: "https: :443\n",
+		err:    "HTTPS requires a TLS certificate",
+	}, {
+		args: []string{"--https", ":443", "--cert", "cert.pem"},
+		err:  "HTTPS requires a TLS private key",
+	}, {
+		args: []string{"--https", ":443", "--cert", "cert.pem", "--key", "key.pem", "--client-auth", "always"},
+		err:  `unknown client-auth "always"`,
+	}, {
+		args: []string{"--client-auth", "request"},
+		err:  "client certificates require HTTPS",
+	}, {
+		args: []string{"--https", ":443", "--cert", "cert.pem", "--key", "key.pem", "--client-auth", "require-and-verify"},
+		err:  "client-auth require-and-verify requires a client-ca",
+	}, {
+		args: []string{"--prefix", "/objects"},
+		err:  `prefix "/objects" must begin and end with /`,
+	}, {
+		args: []string{"--trusted-proxies", "10.0.0.0/8,proxy.example.com"},
+		err:  `invalid trusted proxy "proxy.example.com"`,
+	}, {
+		args: []string{"--dedup", "--master-keys", "/etc/oostore/master-keys"},
+		err:  "encryption at rest can't be combined with dedup",
+	}, {
+		config: "storage:\n  backend: s3\n",
+		err:    `unknown storage backend "s3"`,
+	}, {
+		config: "storage:\n  backend: memory\ngc:\n  interval: 1h\n",
+		err:    "garbage collection requires the postgres backend",
+	}, {
+		args: []string{"--backend", "memory", "--audit-db"},
+		err:  "recording audit decisions in the database requires the postgres backend",
+	}, {
+		config: "storage:\n  compress-min-size: -1\n",
+		err:    "invalid compress-min-size -1",
+	}, {
+		args: []string{"--max-object-size", "-1"},
+		err:  "invalid max-object-size -1",
+	}, {
+		config: "limits:\n  owner-quota: -1\n",
+		err:    "invalid owner-quota -1",
+	}, {
+		config: "rate-limits:\n  create:\n    client: 10\n",
+		err:    `route "create": invalid rate limit "10", expected N/duration`,
+	}, {
+		config: "root-keys:\n  expiry: 1h\n  interval: 0s\n",
+		err:    "invalid root key interval 0s",
+	}, {
+		args: []string{"--shutdown-timeout", "0"},
+		err:  "invalid shutdown timeout 0s",
+	}} {
+		comment := gc.Commentf("test#%d", i)
+		args := test.args
+		if test.config != "" {
+			args = append([]string{"--config", s.writeConfig(c, test.config)}, args...)
+		}
+		_, err := s.load(c, args...)
+		c.Assert(err, gc.ErrorMatches, test.err, comment)
+	}
+}
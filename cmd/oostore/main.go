@@ -17,14 +17,20 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
 	"gopkg.in/tomb.v2"
 
 	"github.com/cmars/oostore"
@@ -36,91 +42,508 @@ const (
 	defaultHTTPS = ":20443"
 )
 
+// flags are the global command line flags, which override the values in
+// any configuration file.
+var flags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "config",
+		Usage: "read configuration from this YAML file; flags override its values",
+	},
+	cli.StringFlag{
+		Name:  "http",
+		Value: defaultHTTP,
+		Usage: "HTTP listen address",
+	},
+	cli.StringFlag{
+		Name:  "https",
+		Usage: "HTTPS listen address",
+	},
+	cli.StringFlag{
+		Name:  "cert",
+		Usage: "TLS certificate and certification chain, PEM encoded; reloaded on SIGHUP",
+	},
+	cli.StringFlag{
+		Name:  "key",
+		Usage: "TLS private key, PEM encoded",
+	},
+	cli.StringFlag{
+		Name:  "client-auth",
+		Value: "none",
+		Usage: "ask HTTPS clients for certificates: none, request, require, verify-if-given or require-and-verify",
+	},
+	cli.StringFlag{
+		Name:  "client-ca",
+		Usage: "CA certificates to verify HTTPS client certificates with, PEM encoded",
+	},
+	cli.StringFlag{
+		Name:  "prefix",
+		Value: "/",
+	},
+	cli.StringFlag{
+		Name:  "trusted-proxies",
+		Usage: "comma-separated addresses and networks of proxies trusted to give client addresses in Forwarded or X-Forwarded-For headers",
+	},
+	cli.BoolFlag{
+		Name:  "cors",
+		Usage: "allow web apps from any origin to make cross-origin requests, leaving origin caveats to restrict them",
+	},
+	cli.StringFlag{
+		Name:  "backend",
+		Value: backendPostgres,
+		Usage: "object storage backend, postgres or memory",
+	},
+	cli.BoolFlag{
+		Name:  "dedup",
+		Usage: "store identical object contents only once",
+	},
+	cli.BoolFlag{
+		Name:  "compress",
+		Usage: "gzip-compress objects with compressible content types",
+	},
+	cli.IntFlag{
+		Name:  "compress-min-size",
+		Value: oostore.DefaultCompressMinSize,
+		Usage: "size in bytes below which objects are not compressed",
+	},
+	cli.BoolFlag{
+		Name:  "object-keys",
+		Usage: "encrypt new objects with keys carried only by their macaroons",
+	},
+	cli.StringFlag{
+		Name:  "master-keys",
+		Usage: "encrypt objects at rest with master keys from this file, one \"id base64-key\" per line, current key first",
+	},
+	cli.Int64Flag{
+		Name:  "max-object-size",
+		Value: defaultMaxObjectSize,
+		Usage: "refuse objects larger than this many bytes; 0 is unlimited",
+	},
+	cli.Int64Flag{
+		Name:  "quota",
+		Usage: "refuse new objects once this many bytes are stored in total; 0 is unlimited",
+	},
+	cli.Int64Flag{
+		Name:  "owner-quota",
+		Usage: "refuse new objects once their owner has stored this many bytes; 0 is unlimited",
+	},
+	cli.DurationFlag{
+		Name:  "root-key-expiry",
+		Usage: "rotate macaroon root keys, expiring each this long after it was last used; macaroons are not honored after their root key expires",
+	},
+	cli.DurationFlag{
+		Name:  "root-key-interval",
+		Value: 24 * time.Hour,
+		Usage: "how long each macaroon root key is used for new macaroons, with --root-key-expiry",
+	},
+	cli.DurationFlag{
+		Name:  "gc-interval",
+		Usage: "collect garbage this often while serving",
+	},
+	cli.DurationFlag{
+		Name:  "gc-grace",
+		Value: time.Hour,
+		Usage: "only collect root keys older than this",
+	},
+	cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Value: 30 * time.Second,
+		Usage: "how long to wait for requests in flight to complete on SIGINT or SIGTERM",
+	},
+	cli.StringFlag{
+		Name:  "metrics",
+		Usage: "serve Prometheus metrics at /metrics on this listen address",
+	},
+	cli.StringFlag{
+		Name:  "audit-log",
+		Usage: "append a JSON record of every authorization decision to this file",
+	},
+	cli.BoolFlag{
+		Name:  "audit-db",
+		Usage: "record every authorization decision in the audit table",
+	},
+	cli.StringFlag{
+		Name:  "log-file",
+		Usage: "append log messages to this file instead of standard error",
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "oostore"
 	app.Usage = "Opaque Object Storage Service"
-	app.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:  "http",
-			Value: defaultHTTP,
-			Usage: "HTTP listen address",
-		},
-		cli.StringFlag{
-			Name:  "https",
-			Usage: "HTTPS listen address",
-		},
-		cli.StringFlag{
-			Name:  "cert",
-			Usage: "TLS certificate and certification chain, PEM encoded",
+	app.Flags = flags
+	app.Commands = []cli.Command{{
+		Name:  "rewrap",
+		Usage: "rewrap object data keys with the current master key, so previous keys may be retired",
+		Action: func(c *cli.Context) {
+			cfg, logFile := setUp(c)
+			defer closeLog(logFile)
+			db := openDB(cfg)
+			defer closeDB(db)
+			// Rewrapping doesn't change contents, so compression is
+			// irrelevant here.
+			storage := cfg.Storage
+			storage.Compress = false
+			objectStore := wrapObjectStore(newPostgresStore(db, storage.Dedup), storage)
+			encStore, ok := objectStore.(*oostore.EncryptedStorage)
+			if !ok {
+				log.Fatalf("no master keys configured")
+			}
+			n, err := encStore.Rewrap()
+			if err != nil {
+				log.Fatalf("failed to rewrap: %s", errgo.Details(err))
+			}
+			log.Printf("rewrapped %d objects", n)
 		},
-		cli.StringFlag{
-			Name:  "key",
-			Usage: "TLS private key, PEM encoded",
+	}, {
+		Name:  "gc",
+		Usage: "remove root keys of macaroons for deleted objects, expired root keys, and collection memberships of deleted objects; collection and owner root keys are kept, and the postgres backend is required",
+		Action: func(c *cli.Context) {
+			cfg, logFile := setUp(c)
+			defer closeLog(logFile)
+			db := openDB(cfg)
+			defer closeDB(db)
+			collector := newCollector(db, newPostgresStore(db, cfg.Storage.Dedup), cfg.GC.Grace)
+			n, err := collector.Collect()
+			if err != nil {
+				log.Fatalf("failed to collect garbage: %s", errgo.Details(err))
+			}
+			log.Printf("removed %d root keys and collection memberships", n)
 		},
-		cli.StringFlag{
-			Name: "prefix",
-		},
-	}
+	}}
 	app.Action = func(c *cli.Context) {
-		dsn := "host=/var/run/postgresql database=oostore"
-		if c.Args().Present() {
-			dsn = strings.Join(c.Args(), " ")
-		}
-		db, err := sql.Open("postgres", dsn)
+		cfg, logFile := setUp(c)
+		err := serve(cfg)
 		if err != nil {
-			log.Fatalf("cannot connect to database: %s", errgo.Details(err))
+			log.Printf("%s", errgo.Details(err))
 		}
-		objectStore, err := postgres.NewObjectStorage(db)
+		closeLog(logFile)
 		if err != nil {
-			log.Fatalf("failed to instantiate object storage: %s", errgo.Details(err))
+			os.Exit(1)
 		}
-		bakeryStore, err := postgres.NewBakeryStorage(db)
+	}
+	app.Run(os.Args)
+}
+
+// setUp loads and validates the configuration, exiting if it is not valid,
+// and directs log messages as configured. The log file opened, if any, is
+// also returned, to be closed on exit.
+func setUp(c *cli.Context) (*config, io.Closer) {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if cfg.Log.File == "" {
+		return cfg, nil
+	}
+	f, err := os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("failed to open log file: %s", errgo.Details(err))
+	}
+	log.SetOutput(f)
+	return cfg, f
+}
+
+func closeLog(f io.Closer) {
+	if f == nil {
+		return
+	}
+	log.SetOutput(os.Stderr)
+	if err := f.Close(); err != nil {
+		log.Printf("failed to close log file: %v", err)
+	}
+}
+
+// serve runs the service as configured until it is shut down.
+func serve(cfg *config) error {
+	var db *sql.DB
+	var pgStore oostore.Storage
+	var objectStore oostore.Storage
+	var bakeryStore bakery.Storage
+	var rootKeyStore bakery.RootKeyStorage
+	var collectionStore oostore.CollectionStorage
+	var err error
+	rootKeyPolicy := oostore.RootKeyPolicy{
+		GenerateInterval: cfg.RootKeys.Interval,
+		ExpiryDuration:   cfg.RootKeys.Expiry,
+	}
+	switch cfg.Storage.Backend {
+	case backendPostgres:
+		db = openDB(cfg)
+		defer closeDB(db)
+		pgStore = newPostgresStore(db, cfg.Storage.Dedup)
+		objectStore = pgStore
+		bakeryStore, err = postgres.NewBakeryStorage(db)
 		if err != nil {
 			log.Fatalf("failed to instantiate bakery storage: %s", errgo.Details(err))
 		}
-		service, err := oostore.NewService(oostore.ServiceConfig{
-			ObjectStore: objectStore,
-			BakeryStore: bakeryStore,
-			Prefix:      c.String("prefix"),
-		})
+		if cfg.RootKeys.Expiry > 0 {
+			rootKeyStore, err = postgres.NewRootKeyStorage(db, rootKeyPolicy)
+			if err != nil {
+				log.Fatalf("failed to instantiate root key storage: %s", errgo.Details(err))
+			}
+		}
+		collectionStore, err = postgres.NewCollectionStorage(db)
 		if err != nil {
-			log.Fatalf("failed to create service: %s", errgo.Details(err))
+			log.Fatalf("failed to instantiate collection storage: %s", errgo.Details(err))
+		}
+	case backendMemory:
+		if cfg.Storage.Dedup {
+			objectStore = oostore.NewMemDedupStorage()
+		} else {
+			objectStore = oostore.NewMemStorage()
+		}
+		if cfg.RootKeys.Expiry > 0 {
+			rootKeyStore = oostore.NewMemRootKeyStorage(rootKeyPolicy)
 		}
+		collectionStore = oostore.NewMemCollectionStorage()
+	}
+	objectStore = wrapObjectStore(objectStore, cfg.Storage)
 
-		var t tomb.Tomb
+	var metrics *oostore.Metrics
+	if cfg.Metrics != "" {
+		metrics, err = oostore.NewMetrics()
+		if err != nil {
+			log.Fatalf("failed to instantiate metrics: %s", errgo.Details(err))
+		}
+	}
+	auditSink, auditLog := newAuditSink(db, cfg.Audit)
+	if auditLog != nil {
+		defer func() {
+			if err := auditLog.Close(); err != nil {
+				log.Printf("failed to close audit log: %v", err)
+			}
+		}()
+	}
+	rateLimits, err := cfg.rateLimits()
+	if err != nil {
+		log.Fatalf("invalid rate limits: %s", errgo.Details(err))
+	}
+	trustedProxies, err := cfg.trustedProxies()
+	if err != nil {
+		log.Fatalf("invalid trusted proxies: %s", errgo.Details(err))
+	}
+	service, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore:     objectStore,
+		BakeryStore:     bakeryStore,
+		RootKeyStore:    rootKeyStore,
+		CollectionStore: collectionStore,
+		Prefix:          cfg.Prefix,
+		ObjectKeys:      cfg.Storage.ObjectKeys,
+		Metrics:         metrics,
+		AuditSink:       auditSink,
+		Limits: oostore.Limits{
+			MaxObjectSize: cfg.Limits.MaxObjectSize,
+			Quota:         cfg.Limits.Quota,
+			OwnerQuota:    cfg.Limits.OwnerQuota,
+		},
+		RateLimits:     rateLimits,
+		TrustedProxies: trustedProxies,
+		CORS:           cfg.CORS,
+	})
+	if err != nil {
+		log.Fatalf("failed to create service: %s", errgo.Details(err))
+	}
 
-		httpAddr := c.String("http")
-		if httpAddr != "" {
-			t.Go(func() error {
-				log.Printf("listening for HTTP requests on %q", httpAddr)
-				err := http.ListenAndServe(httpAddr, service)
-				if err != nil {
-					log.Fatalf("server error: %s", errgo.Details(err))
-				}
-				return err
-			})
-		}
-		httpsAddr := c.String("https")
-		if httpsAddr != "" {
-			t.Go(func() error {
-				certFile := c.String("cert")
-				if certFile == "" {
-					log.Fatalf("missing --cert flag")
-				}
-				keyFile := c.String("key")
-				if keyFile == "" {
-					log.Fatalf("missing --key flag")
-				}
-				log.Printf("listening for HTTPS requests on %q", httpsAddr)
-				err := http.ListenAndServeTLS(httpsAddr, certFile, keyFile, service)
-				if err != nil {
-					log.Fatalf("server error: %s", errgo.Details(err))
+	var cert *certificate
+	var tlsConf *tls.Config
+	if cfg.HTTPS != "" {
+		cert, err = newCertificate(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			log.Fatalf("failed to load TLS certificate: %s", errgo.Details(err))
+		}
+		tlsConf, err = newTLSConfig(cfg.TLS, cert)
+		if err != nil {
+			log.Fatalf("failed to load TLS client CA certificates: %s", errgo.Details(err))
+		}
+	}
+
+	var t tomb.Tomb
+	handleSignals(&t, cert)
+
+	if cfg.GC.Interval > 0 {
+		collector := newCollector(db, pgStore, cfg.GC.Grace)
+		t.Go(func() error {
+			ticker := time.NewTicker(cfg.GC.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					n, err := collector.Collect()
+					if err != nil {
+						log.Printf("failed to collect garbage: %s", errgo.Details(err))
+					} else if n > 0 {
+						log.Printf("removed %d root keys and collection memberships", n)
+					}
+				case <-t.Dying():
+					return nil
 				}
-				return err
-			})
+			}
+		})
+	}
+
+	srvs := newServers(&t, cfg.ShutdownTimeout)
+	if metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		srv := &http.Server{Addr: cfg.Metrics, Handler: mux}
+		srvs.serve("metrics", srv, srv.ListenAndServe)
+	}
+	if cfg.HTTP != "" {
+		srv := &http.Server{Addr: cfg.HTTP, Handler: service}
+		srvs.serve("HTTP", srv, srv.ListenAndServe)
+	}
+	if cfg.HTTPS != "" {
+		srv := &http.Server{
+			Addr:      cfg.HTTPS,
+			Handler:   service,
+			TLSConfig: tlsConf,
 		}
-		t.Wait()
+		srvs.serve("HTTPS", srv, func() error {
+			return srv.ListenAndServeTLS("", "")
+		})
 	}
-	app.Run(os.Args)
+	return t.Wait()
+}
+
+func openDB(cfg *config) *sql.DB {
+	if cfg.Storage.Backend != backendPostgres {
+		log.Fatalf("the %s storage backend has no database", cfg.Storage.Backend)
+	}
+	db, err := sql.Open("postgres", cfg.Database)
+	if err != nil {
+		log.Fatalf("cannot connect to database: %s", errgo.Details(err))
+	}
+	return db
+}
+
+func closeDB(db *sql.DB) {
+	if err := db.Close(); err != nil {
+		log.Printf("failed to close database: %v", err)
+	}
+}
+
+func newCollector(db *sql.DB, objectStore oostore.Storage, grace time.Duration) *postgres.Collector {
+	collector, err := postgres.NewCollector(db, objectStore, grace)
+	if err != nil {
+		log.Fatalf("failed to instantiate garbage collector: %s", errgo.Details(err))
+	}
+	return collector
+}
+
+// newAuditSink returns a sink recording authorization decisions as
+// configured, or nil if they are not to be recorded. The file opened for
+// the sink, if any, is also returned, to be closed on shutdown.
+func newAuditSink(db *sql.DB, config auditConfig) (oostore.AuditSink, *os.File) {
+	var sinks auditSinks
+	var f *os.File
+	if config.Log != "" {
+		var err error
+		f, err = os.OpenFile(config.Log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %s", errgo.Details(err))
+		}
+		sinks = append(sinks, oostore.NewJSONAuditSink(f))
+	}
+	if config.DB {
+		sink, err := postgres.NewAuditSink(db)
+		if err != nil {
+			log.Fatalf("failed to instantiate audit sink: %s", errgo.Details(err))
+		}
+		sinks = append(sinks, sink)
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, f
+	case 1:
+		return sinks[0], f
+	}
+	return sinks, f
+}
+
+// auditSinks records authorization decisions to each of several sinks.
+type auditSinks []oostore.AuditSink
+
+// Record implements oostore.AuditSink.
+func (sinks auditSinks) Record(rec *oostore.AuditRecord) error {
+	var firstErr error
+	for _, sink := range sinks {
+		err := sink.Record(rec)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func newPostgresStore(db *sql.DB, dedup bool) oostore.Storage {
+	var objectStore oostore.Storage
+	var err error
+	if dedup {
+		objectStore, err = postgres.NewDedupStorage(db)
+	} else {
+		objectStore, err = postgres.NewObjectStorage(db)
+	}
+	if err != nil {
+		log.Fatalf("failed to instantiate object storage: %s", errgo.Details(err))
+	}
+	return objectStore
+}
+
+// wrapObjectStore wraps the underlying object storage as configured.
+func wrapObjectStore(objectStore oostore.Storage, config storeConfig) oostore.Storage {
+	if config.MasterKeys != "" {
+		keys, err := readMasterKeys(config.MasterKeys)
+		if err != nil {
+			log.Fatalf("failed to read master keys: %s", errgo.Details(err))
+		}
+		objectStore, err = oostore.NewEncryptedStorage(objectStore, keys[0], keys[1:]...)
+		if err != nil {
+			log.Fatalf("failed to instantiate encrypted storage: %s", errgo.Details(err))
+		}
+	}
+	// Contents must be compressed before they are encrypted.
+	if config.Compress {
+		encodedStore, ok := objectStore.(oostore.EncodedStorage)
+		if !ok {
+			log.Fatalf("object storage does not support compression")
+		}
+		objectStore = oostore.NewCompressedStorage(encodedStore, config.CompressMinSize)
+	}
+	return objectStore
+}
+
+// readMasterKeys reads master keys from a file containing lines of the form
+// "id base64-key". The first key is the current one. Blank lines and lines
+// starting with # are ignored.
+func readMasterKeys(path string) ([]oostore.MasterKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	var keys []oostore.MasterKey
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errgo.Newf("invalid master key line %q", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid master key %q", fields[0])
+		}
+		keys = append(keys, oostore.MasterKey{ID: fields[0], Key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(keys) == 0 {
+		return nil, errgo.Newf("no master keys in %q", path)
+	}
+	return keys, nil
 }
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+)
+
+// servers runs HTTP servers until they are told to shut down.
+type servers struct {
+	t               *tomb.Tomb
+	shutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	servers []*http.Server
+}
+
+// newServers returns servers which run in t, and which are given
+// shutdownTimeout to finish serving requests in flight once t is dying.
+func newServers(t *tomb.Tomb, shutdownTimeout time.Duration) *servers {
+	s := &servers{t: t, shutdownTimeout: shutdownTimeout}
+	t.Go(s.shutdown)
+	return s
+}
+
+// serve runs srv, with listen starting it, until shutdown. The name of the
+// server is used in log messages.
+func (s *servers) serve(name string, srv *http.Server, listen func() error) {
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+	s.t.Go(func() error {
+		log.Printf("listening for %s requests on %q", name, srv.Addr)
+		err := listen()
+		if err != nil && err != http.ErrServerClosed {
+			return errgo.Notef(err, "%s server error", name)
+		}
+		return nil
+	})
+}
+
+// shutdown waits until the tomb is dying, and then shuts down the servers,
+// allowing requests in flight to complete until the shutdown timeout.
+func (s *servers) shutdown() error {
+	<-s.t.Dying()
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range s.servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				log.Printf("failed to shut down server on %q gracefully: %v", srv.Addr, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	return nil
+}
+
+// handleSignals kills t on SIGINT or SIGTERM, and reloads the TLS
+// certificate, if there is one, on SIGHUP.
+func handleSignals(t *tomb.Tomb, cert *certificate) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	t.Go(func() error {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case sig := <-signals:
+				if sig != syscall.SIGHUP {
+					log.Printf("received %v, shutting down", sig)
+					t.Kill(nil)
+					return nil
+				}
+				if cert == nil {
+					continue
+				}
+				err := cert.reload()
+				if err != nil {
+					log.Printf("failed to reload TLS certificate: %s", errgo.Details(err))
+				} else {
+					log.Printf("reloaded TLS certificate")
+				}
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
+
+// newTLSConfig returns the TLS configuration of the HTTPS server, which
+// serves cert and asks clients for certificates as configured.
+func newTLSConfig(cfg tlsConfig, cert *certificate) (*tls.Config, error) {
+	conf := &tls.Config{
+		GetCertificate: cert.getCertificate,
+		ClientAuth:     clientAuthTypes[cfg.ClientAuth],
+	}
+	if cfg.ClientCA != "" {
+		buf, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(buf) {
+			return nil, errgo.Newf("no certificates found in %q", cfg.ClientCA)
+		}
+	}
+	return conf, nil
+}
+
+// certificate is a TLS certificate which can be reloaded from its files
+// while it is being served.
+type certificate struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertificate loads a certificate and its private key, PEM encoded, from
+// the given files.
+func newCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	err := c.reload()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c, nil
+}
+
+// reload loads the certificate from its files again. If this fails, the
+// certificate previously loaded continues to be served.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (c *certificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
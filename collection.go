@@ -0,0 +1,209 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// CollectionStorage defines the interface that is used to group object IDs
+// into collections, so that they may be authorized together.
+type CollectionStorage interface {
+	// Create creates a new, empty collection with the given ID.
+	Create(id string) error
+
+	// Add adds an object ID to a collection. Adding an object that is
+	// already a member has no effect.
+	Add(id string, objectID string) error
+
+	// Members returns the object IDs in a collection.
+	Members(id string) ([]string, error)
+
+	// HasMember returns whether an object ID is in a collection.
+	HasMember(id string, objectID string) (bool, error)
+
+	// RemoveObject removes an object ID from every collection it is a
+	// member of, when the object is deleted. Removing an object that is
+	// in no collection has no effect.
+	RemoveObject(objectID string) error
+}
+
+// addToCollectionRequest is the JSON request body accepted when adding an
+// object to a collection. Both the collection and the object must be
+// authorized.
+type addToCollectionRequest struct {
+	Collection macaroon.Slice `json:"collection"`
+	Object     macaroon.Slice `json:"object"`
+}
+
+// collectionMembers is the JSON response to a request to list a
+// collection.
+type collectionMembers struct {
+	Members []string `json:"members"`
+}
+
+// createCollection handles the request to create a new, empty collection,
+// responding with a macaroon that can be used to add objects to it, list its
+// members, and fetch any of them.
+func (s *Service) createCollection(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id, err := newID()
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create a collection ID"))
+		return
+	}
+
+	err = s.collections.Create(id)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create collection"))
+		return
+	}
+
+	m, err := s.bakery.NewMacaroon("", nil, []checkers.Caveat{{
+		Condition: fmt.Sprintf("%s %s", condCollection, id),
+	}})
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create macaroon"))
+		return
+	}
+	w.Header().Set("Location", path.Join(s.apiPrefix, "collection", id))
+
+	err = json.NewEncoder(w).Encode(macaroon.Slice{m})
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// listCollection handles the request to list the objects in a collection.
+func (s *Service) listCollection(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, err := s.checkRequest(requestInfo{request: r, params: p, operation: "list"})
+	if err != nil {
+		authErrorf(w, err)
+		return
+	}
+
+	id := p.ByName("collection")
+	members, err := s.collections.Members(id)
+	if err == ErrNotFound {
+		httpErrorf(w, http.StatusNotFound, errgo.Newf("not found: %q", id))
+		return
+	} else if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to list %q", id))
+		return
+	}
+	if members == nil {
+		members = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(collectionMembers{Members: members})
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// addToCollection handles the request to add an object to a collection. The
+// client must be authorized to add to the collection, and to fetch the
+// object, since every holder of the collection macaroon will be able to
+// fetch it afterwards.
+func (s *Service) addToCollection(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req addToCollectionRequest
+	body, err := readJSON(r, &req)
+	if err != nil {
+		httpErrorf(w, http.StatusBadRequest, errgo.Notef(err, "invalid request"))
+		return
+	}
+
+	// Each macaroon is checked against only the parameter it is meant to
+	// authorize, so that one can't stand in for the other.
+	id, objectID := p.ByName("collection"), p.ByName("object")
+	_, err = s.checkMacaroons(req.Collection, requestInfo{
+		request:   r,
+		params:    httprouter.Params{{Key: "collection", Value: id}},
+		operation: "add",
+		body:      body,
+	})
+	if err != nil {
+		authErrorf(w, err)
+		return
+	}
+	auth, err := s.checkMacaroons(req.Object, requestInfo{
+		request:   r,
+		params:    httprouter.Params{{Key: "object", Value: objectID}},
+		operation: "fetch",
+		body:      body,
+	})
+	if err != nil {
+		authErrorf(w, err)
+		return
+	}
+	if auth.objectKey != nil {
+		// The service can't decrypt the object for collection members.
+		httpErrorf(w, http.StatusBadRequest, errgo.Newf("object %q is encrypted with a key bound to its macaroon", objectID))
+		return
+	}
+
+	err = s.collections.Add(id, objectID)
+	if err == ErrNotFound {
+		httpErrorf(w, http.StatusNotFound, errgo.Newf("not found: %q", id))
+		return
+	} else if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to add %q to %q", objectID, id))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// collectionChecker checks "collection" caveats. A collection macaroon may
+// be used to fetch any object in the collection, or to operate on the
+// collection itself.
+func collectionChecker(store CollectionStorage, info requestInfo) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condCollection,
+		Check_: func(_, cav string) error {
+			switch operations[info.operation] {
+			case "collection":
+				if cav != info.params.ByName("collection") {
+					return errgo.New("request does not match")
+				}
+				return nil
+			case "object":
+				if info.operation != "fetch" {
+					return fmt.Errorf("operation %q not allowed", info.operation)
+				}
+				ok, err := store.HasMember(cav, info.params.ByName("object"))
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				if !ok {
+					return errgo.New("request does not match")
+				}
+				return nil
+			}
+			return fmt.Errorf("operation %q not allowed", info.operation)
+		},
+	}
+}
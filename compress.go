@@ -0,0 +1,179 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+)
+
+// DefaultCompressMinSize is the size in bytes below which CompressedStorage
+// stores contents as they are, if no other threshold is given.
+const DefaultCompressMinSize = 1024
+
+// EncodedGetter is implemented by Storage backends which can return object
+// contents as they are stored, along with the content encoding needed to
+// decode them, so that they may be served without decoding.
+type EncodedGetter interface {
+	// GetEncoded returns the content bytes, content-type and
+	// content-encoding for the given ID. An empty encoding means the
+	// contents are not encoded.
+	GetEncoded(id string) ([]byte, string, string, error)
+}
+
+// EncodedStorage is implemented by Storage backends which record the
+// content encoding of each object separately from its content type, so
+// that contents may be stored encoded. Get returns the contents decoded.
+type EncodedStorage interface {
+	Storage
+	EncodedGetter
+
+	// PutEncoded stores new contents in the given content encoding, like
+	// PutOwned. An empty encoding is the same as PutOwned.
+	PutEncoded(id string, contents []byte, contentType string, encoding string, owner string) error
+}
+
+// EncodedCreator is implemented by EncodedStorage backends which are also
+// AtomicCreators.
+type EncodedCreator interface {
+	// CreateEncodedObject stores a new object in the given content
+	// encoding, like CreateObject.
+	CreateEncodedObject(id string, contents []byte, contentType string, encoding string, owner string, newMacaroon func(bakery.Storage) error) error
+}
+
+// DecodeContents returns contents stored in the given content encoding,
+// decoded.
+func DecodeContents(contents []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return contents, nil
+	case "gzip":
+		return gunzip(contents)
+	}
+	return nil, errgo.Newf("unknown encoding %q", encoding)
+}
+
+// CompressedStorage is a Storage which gzip-compresses the contents of
+// objects with compressible content types. The encoding is recorded by the
+// wrapped Storage, which decodes the contents again when they are got.
+// Sizes given by List are of the contents as stored.
+type CompressedStorage struct {
+	EncodedStorage
+	minSize int
+}
+
+// NewCompressedStorage returns a new CompressedStorage wrapping store.
+// Contents smaller than minSize bytes are not compressed.
+func NewCompressedStorage(store EncodedStorage, minSize int) *CompressedStorage {
+	return &CompressedStorage{
+		EncodedStorage: store,
+		minSize:        minSize,
+	}
+}
+
+// Put implements Storage.
+func (s *CompressedStorage) Put(id string, contents []byte, contentType string) error {
+	return s.PutOwned(id, contents, contentType, "")
+}
+
+// PutOwned implements Storage.
+func (s *CompressedStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	contents, encoding, err := s.encode(contents, contentType)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.EncodedStorage.PutEncoded(id, contents, contentType, encoding, owner), errgo.Any)
+}
+
+// CreateObject implements AtomicCreator, if the wrapped Storage is an
+// EncodedCreator.
+func (s *CompressedStorage) CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error {
+	ec, ok := s.EncodedStorage.(EncodedCreator)
+	if !ok {
+		return ErrNotAtomic
+	}
+	contents, encoding, err := s.encode(contents, contentType)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return ec.CreateEncodedObject(id, contents, contentType, encoding, owner, newMacaroon)
+}
+
+// encode returns contents compressed if they are worth compressing, along
+// with the content encoding to store them in.
+func (s *CompressedStorage) encode(contents []byte, contentType string) ([]byte, string, error) {
+	if len(contents) < s.minSize || !compressible(contentType) {
+		return contents, "", nil
+	}
+	compressed, err := gzipContents(contents)
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	// Contents that don't get any smaller, such as those already compressed
+	// or encrypted, are stored as they are.
+	if len(compressed) >= len(contents) {
+		return contents, "", nil
+	}
+	return compressed, "gzip", nil
+}
+
+// compressible returns whether contents of the given type are likely to be
+// worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml":
+		return true
+	}
+	return false
+}
+
+func gzipContents(contents []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(contents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzip(contents []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// compressedServiceSuite runs the service tests against compressing
+// storage.
+type compressedServiceSuite struct {
+	serviceSuite
+}
+
+var _ = gc.Suite(&compressedServiceSuite{})
+
+func (s *compressedServiceSuite) SetUpTest(c *gc.C) {
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewCompressedStorage(oostore.NewMemStorage(), 0),
+	})
+}
+
+func (s *compressedServiceSuite) TestContentEncoding(c *gc.C) {
+	// Don't let the client negotiate and decode on our behalf.
+	cl := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	text := strings.Repeat("all work and no play makes jack a dull boy\n", 100)
+	resp, err := cl.Post(s.server.URL, "text/plain", bytes.NewBufferString(text))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for i, testCase := range []struct {
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "gzip"},
+		{"*, gzip;q=0", ""},
+		{"identity", ""},
+	} {
+		comment := gc.Commentf("test#%d: %#v", i, testCase)
+		req, err := http.NewRequest("POST", s.server.URL+loc, bytes.NewBuffer(mjson.Bytes()))
+		c.Assert(err, gc.IsNil, comment)
+		if testCase.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", testCase.acceptEncoding)
+		}
+		resp, err := cl.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, comment)
+		c.Assert(resp.Header.Get("Content-Type"), gc.Equals, "text/plain", comment)
+		c.Assert(resp.Header.Get("Content-Encoding"), gc.Equals, testCase.contentEncoding, comment)
+		c.Assert(resp.Header.Get("Vary"), gc.Equals, "Accept-Encoding", comment)
+		var body io.Reader = resp.Body
+		if testCase.contentEncoding == "gzip" {
+			body, err = gzip.NewReader(resp.Body)
+			c.Assert(err, gc.IsNil, comment)
+		}
+		contents, err := ioutil.ReadAll(body)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(string(contents), gc.Equals, text, comment)
+	}
+}
+
+func (s *compressedServiceSuite) TestCompressedStorage(c *gc.C) {
+	raw := oostore.NewMemStorage()
+	store := oostore.NewCompressedStorage(raw, 16)
+	text := strings.Repeat("a", 100)
+	c.Assert(store.PutOwned("text", []byte(text), "text/plain; charset=utf-8", "alice"), gc.IsNil)
+	c.Assert(store.PutOwned("short", []byte("a"), "text/plain", "alice"), gc.IsNil)
+	c.Assert(store.PutOwned("binary", []byte(text), "application/octet-stream", "alice"), gc.IsNil)
+
+	for i, testCase := range []struct {
+		id, contents, contentType string
+		compressed                bool
+	}{
+		{"text", text, "text/plain; charset=utf-8", true},
+		{"short", "a", "text/plain", false},
+		{"binary", text, "application/octet-stream", false},
+	} {
+		comment := gc.Commentf("test#%d: %#v", i, testCase)
+		stored, contentType, encoding, err := raw.GetEncoded(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(string(stored) == testCase.contents, gc.Equals, !testCase.compressed, comment)
+		c.Assert(contentType, gc.Equals, testCase.contentType, comment)
+		c.Assert(encoding != "", gc.Equals, testCase.compressed, comment)
+		contents, contentType, err := store.Get(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(contentType, gc.Equals, testCase.contentType, comment)
+		c.Assert(string(contents), gc.Equals, testCase.contents, comment)
+		// Contents stay readable without the compressing wrapper.
+		contents, contentType, err = raw.Get(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(contentType, gc.Equals, testCase.contentType, comment)
+		c.Assert(string(contents), gc.Equals, testCase.contents, comment)
+	}
+
+	infos, err := raw.List("alice", "", 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 3)
+	for _, info := range infos {
+		c.Assert(info.ContentType, gc.Matches, "(text/plain.*|application/octet-stream)")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// condContentType restricts the objects which may be fetched to those
+// stored with a content type matching any of a comma-separated list of
+// media ranges, such as "image/*".
+const condContentType = "content-type"
+
+// parseMediaRanges parses a comma-separated list of media ranges, each of
+// which is a type and subtype, "type/*" or "*/*".
+func parseMediaRanges(arg string) ([]string, error) {
+	var ranges []string
+	for _, r := range strings.Split(arg, ",") {
+		r = strings.ToLower(strings.TrimSpace(r))
+		parts := strings.Split(r, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" ||
+			(parts[0] == "*" && parts[1] != "*") || strings.ContainsAny(r, " \t;") {
+			return nil, fmt.Errorf("invalid media range %q", r)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// matchesMediaRange returns whether the media type of contentType, without
+// any parameters, is within the media range r.
+func matchesMediaRange(contentType, r string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if r == "*/*" {
+		return true
+	}
+	if strings.HasSuffix(r, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(r, "*"))
+	}
+	return mediaType == r
+}
+
+// contentTypeChecker checks that content-type caveats are well-formed. The
+// content type of an object is not known until it is fetched from storage,
+// so the caveats are checked against it by checkContentType after the
+// macaroon has been verified.
+func contentTypeChecker() checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condContentType,
+		Check_: func(_, cav string) error {
+			_, err := parseMediaRanges(cav)
+			return err
+		},
+	}
+}
+
+// contentTypeCaveats returns the media ranges of each content-type caveat
+// on the macaroons in ms, including those added to discharge macaroons.
+func contentTypeCaveats(ms macaroon.Slice) [][]string {
+	var caveats [][]string
+	for _, m := range ms {
+		for _, cav := range m.Caveats() {
+			if cav.Location != "" {
+				continue
+			}
+			cond, arg, err := checkers.ParseCaveat(cav.Id)
+			if err != nil || cond != condContentType {
+				continue
+			}
+			ranges, err := parseMediaRanges(arg)
+			if err != nil {
+				continue
+			}
+			caveats = append(caveats, ranges)
+		}
+	}
+	return caveats
+}
+
+// checkContentType checks that contentType is within a media range of every
+// content-type caveat the request was authorized with.
+func (auth *authInfo) checkContentType(contentType string) error {
+	for _, ranges := range auth.contentTypes {
+		var ok bool
+		for _, r := range ranges {
+			if matchesMediaRange(contentType, r) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("content type %q not allowed", contentType)
+		}
+	}
+	return nil
+}
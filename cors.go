@@ -0,0 +1,65 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"net/http"
+)
+
+// corsAllowMethods are the methods cross-origin requests may use.
+const corsAllowMethods = "POST, PUT, DELETE"
+
+// corsExposeHeaders are the response headers cross-origin requests may
+// read.
+const corsExposeHeaders = "Location, Retry-After, Content-Encoding"
+
+// corsMaxAge is how long, in seconds, browsers may cache the response to a
+// preflight request.
+const corsMaxAge = "600"
+
+// cors adds CORS headers to the response to a cross-origin request, and
+// responds to preflight requests itself. It returns whether the request has
+// been responded to.
+//
+// Requests are authorized by macaroons given explicitly rather than by
+// cookies, so allowing other origins does not let them act on behalf of the
+// user. Every origin is allowed here, and the origin caveats of the
+// macaroon presented decide which origins may use it.
+func (s *Service) cors(w http.ResponseWriter, r *http.Request) bool {
+	if !s.allowCORS {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		// Any header may be sent, as header caveats may require any.
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// corsServiceSuite runs the service tests allowing cross-origin requests.
+type corsServiceSuite struct {
+	serviceSuite
+}
+
+var _ = gc.Suite(&corsServiceSuite{})
+
+func (s *corsServiceSuite) SetUpTest(c *gc.C) {
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		CORS:        true,
+	})
+}
+
+func (s *corsServiceSuite) TestCORS(c *gc.C) {
+	resp, err := http.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Access-Control-Allow-Origin"), gc.Equals, "")
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	auth = withCaveat(c, auth, "origin https://app.example.com")
+
+	for i, origin := range []string{"https://app.example.com", "https://evil.example.com"} {
+		comment := gc.Commentf("test#%d: %s", i, origin)
+
+		// Preflight requests are answered for any origin, as the
+		// macaroon is not sent with them.
+		req, err := http.NewRequest("OPTIONS", s.server.URL+loc, nil)
+		c.Assert(err, gc.IsNil, comment)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-tenant")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent, comment)
+		c.Assert(resp.Header.Get("Vary"), gc.Equals, "Origin", comment)
+		c.Assert(resp.Header.Get("Access-Control-Allow-Origin"), gc.Equals, origin, comment)
+		c.Assert(resp.Header.Get("Access-Control-Allow-Methods"), gc.Equals, "POST, PUT, DELETE", comment)
+		c.Assert(resp.Header.Get("Access-Control-Allow-Headers"), gc.Equals, "content-type, x-tenant", comment)
+
+		// The origin caveat decides whether the macaroon may be used.
+		req, err = http.NewRequest("POST", s.server.URL+loc, bytes.NewBuffer(auth))
+		c.Assert(err, gc.IsNil, comment)
+		req.Header.Set("Origin", origin)
+		resp, err = http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.Header.Get("Access-Control-Allow-Origin"), gc.Equals, origin, comment)
+		c.Assert(resp.Header.Get("Access-Control-Expose-Headers"), gc.Equals, "Location, Retry-After, Content-Encoding", comment)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, gc.IsNil, comment)
+		if origin == "https://app.example.com" {
+			c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, comment)
+			c.Assert(string(body), gc.Equals, "hunter2", comment)
+		} else {
+			c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden, comment)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ContentHash returns the key under which deduplicating storage
+// implementations store contents: the hex-encoded SHA-256 hash of it.
+func ContentHash(contents []byte) string {
+	h := sha256.Sum256(contents)
+	return hex.EncodeToString(h[:])
+}
+
+type blobDoc struct {
+	Contents []byte
+	Refs     int
+}
+
+type blobRefDoc struct {
+	Hash        string
+	ContentType string
+	Encoding    string
+	Owner       string
+	Created     time.Time
+}
+
+type memDedupStorage struct {
+	mu      sync.Mutex
+	blobs   map[string]*blobDoc
+	objects map[string]blobRefDoc
+}
+
+// NewMemDedupStorage returns a new storage implementation that only keeps
+// things in memory, storing identical contents only once no matter how many
+// objects are created with it. Contents are reference counted, and released
+// when the last object referring to them is deleted.
+func NewMemDedupStorage() *memDedupStorage {
+	return &memDedupStorage{
+		blobs:   make(map[string]*blobDoc),
+		objects: make(map[string]blobRefDoc),
+	}
+}
+
+// Get implements Storage.
+func (s *memDedupStorage) Get(id string) ([]byte, string, error) {
+	contents, contentType, encoding, err := s.GetEncoded(id)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = DecodeContents(contents, encoding)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot decode %q", id)
+	}
+	return contents, contentType, nil
+}
+
+// GetEncoded implements EncodedGetter.
+func (s *memDedupStorage) GetEncoded(id string) ([]byte, string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.objects[id]
+	if !ok {
+		return nil, "", "", ErrNotFound
+	}
+	return s.blobs[doc.Hash].Contents, doc.ContentType, doc.Encoding, nil
+}
+
+// Put implements Storage.
+func (s *memDedupStorage) Put(id string, contents []byte, contentType string) error {
+	return s.PutOwned(id, contents, contentType, "")
+}
+
+// PutOwned implements Storage.
+func (s *memDedupStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	return s.PutEncoded(id, contents, contentType, "", owner)
+}
+
+// PutEncoded implements EncodedStorage.
+func (s *memDedupStorage) PutEncoded(id string, contents []byte, contentType string, encoding string, owner string) error {
+	hash := ContentHash(contents)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[id]; ok {
+		return fmt.Errorf("object %q already exists", id)
+	}
+	blob, ok := s.blobs[hash]
+	if !ok {
+		blob = &blobDoc{Contents: contents}
+		s.blobs[hash] = blob
+	}
+	blob.Refs++
+	s.objects[id] = blobRefDoc{
+		Hash:        hash,
+		ContentType: contentType,
+		Encoding:    encoding,
+		Owner:       owner,
+		Created:     time.Now().UTC(),
+	}
+	return nil
+}
+
+// Delete implements Storage.
+func (s *memDedupStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.objects[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.objects, id)
+	blob := s.blobs[doc.Hash]
+	blob.Refs--
+	if blob.Refs <= 0 {
+		delete(s.blobs, doc.Hash)
+	}
+	return nil
+}
+
+// List implements Storage.
+func (s *memDedupStorage) List(owner string, after string, limit int) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, doc := range s.objects {
+		if owner != "" && doc.Owner == owner && id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	var result []ObjectInfo
+	for _, id := range ids {
+		doc := s.objects[id]
+		result = append(result, ObjectInfo{
+			ID:          id,
+			ContentType: doc.ContentType,
+			Size:        int64(len(s.blobs[doc.Hash].Contents)),
+			Created:     doc.Created,
+		})
+	}
+	return result, nil
+}
+
+// Usage implements Storage.
+func (s *memDedupStorage) Usage(owner string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	if owner == "" {
+		for _, blob := range s.blobs {
+			total += int64(len(blob.Contents))
+		}
+		return total, nil
+	}
+	for _, doc := range s.objects {
+		if doc.Owner == owner {
+			total += int64(len(s.blobs[doc.Hash].Contents))
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// dedupServiceSuite runs the service tests against deduplicating storage.
+type dedupServiceSuite struct {
+	serviceSuite
+}
+
+var _ = gc.Suite(&dedupServiceSuite{})
+
+func (s *dedupServiceSuite) SetUpTest(c *gc.C) {
+	s.setUpService(c, oostore.ServiceConfig{ObjectStore: oostore.NewMemDedupStorage()})
+}
+
+func (s *dedupServiceSuite) TestSameContents(c *gc.C) {
+	cl := &http.Client{}
+	var locs []string
+	var auths [][]byte
+	for i := 0; i < 2; i++ {
+		resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		locs = append(locs, resp.Header.Get("Location"))
+		var mjson bytes.Buffer
+		_, err = io.Copy(&mjson, resp.Body)
+		c.Assert(err, gc.IsNil)
+		auths = append(auths, mjson.Bytes())
+	}
+	c.Assert(locs[0], gc.Not(gc.Equals), locs[1])
+
+	// Deleting one object leaves the other intact.
+	req, err := http.NewRequest("DELETE", s.server.URL+locs[0], bytes.NewBuffer(auths[0]))
+	c.Assert(err, gc.IsNil)
+	resp, err := cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent)
+
+	resp, err = cl.Post(s.server.URL+locs[1], "application/json", bytes.NewBuffer(auths[1]))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var contents bytes.Buffer
+	_, err = io.Copy(&contents, resp.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(contents.String(), gc.Equals, "hunter2")
+}
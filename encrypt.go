@@ -0,0 +1,337 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+)
+
+// MasterKeySize is the size of a master key in bytes, for AES-256.
+const MasterKeySize = 32
+
+// envelopeVersion is the first byte of contents stored by EncryptedStorage,
+// identifying the envelope format.
+const envelopeVersion = 1
+
+// MasterKey is a key used to wrap the per-object data keys which encrypt
+// object contents.
+type MasterKey struct {
+	// ID identifies the key, and is stored alongside each data key it
+	// wraps. It must be at most 255 bytes long.
+	ID string
+
+	// Key is the AES-256 key material.
+	Key []byte
+}
+
+// ContentRewriter is implemented by Storage backends that can replace the
+// contents of every stored object in place.
+type ContentRewriter interface {
+	// Rewrite calls f with the ID and contents of each stored object. If f
+	// returns non-nil contents, they replace the stored contents.
+	Rewrite(f func(id string, contents []byte) ([]byte, error)) error
+}
+
+// EncryptedStorage is a Storage which encrypts object contents at rest. Each
+// object is sealed with AES-GCM under its own random data key, which is in
+// turn wrapped by a master key and stored with the object. Content types and
+// encodings are not encrypted.
+type EncryptedStorage struct {
+	Storage
+	current MasterKey
+	keys    map[string][]byte
+}
+
+// NewEncryptedStorage returns a new EncryptedStorage wrapping store. New
+// objects are sealed under the current master key. Objects sealed under any
+// of the previous keys can still be opened, until they are rewrapped.
+func NewEncryptedStorage(store Storage, current MasterKey, previous ...MasterKey) (*EncryptedStorage, error) {
+	s := &EncryptedStorage{
+		Storage: store,
+		current: current,
+		keys:    make(map[string][]byte),
+	}
+	for _, k := range append([]MasterKey{current}, previous...) {
+		if len(k.Key) != MasterKeySize {
+			return nil, errgo.Newf("master key %q must be %d bytes", k.ID, MasterKeySize)
+		}
+		if len(k.ID) == 0 || len(k.ID) > 255 {
+			return nil, errgo.Newf("invalid master key ID %q", k.ID)
+		}
+		if _, ok := s.keys[k.ID]; ok {
+			return nil, errgo.Newf("duplicate master key ID %q", k.ID)
+		}
+		s.keys[k.ID] = k.Key
+	}
+	return s, nil
+}
+
+// Get implements Storage.
+func (s *EncryptedStorage) Get(id string) ([]byte, string, error) {
+	contents, contentType, encoding, err := s.GetEncoded(id)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = DecodeContents(contents, encoding)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot decode %q", id)
+	}
+	return contents, contentType, nil
+}
+
+// GetEncoded implements EncodedGetter. The contents are decrypted, but left
+// in the encoding they were stored in.
+func (s *EncryptedStorage) GetEncoded(id string) ([]byte, string, string, error) {
+	var (
+		sealed                []byte
+		contentType, encoding string
+		err                   error
+	)
+	if eg, ok := s.Storage.(EncodedGetter); ok {
+		sealed, contentType, encoding, err = eg.GetEncoded(id)
+	} else {
+		sealed, contentType, err = s.Storage.Get(id)
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	contents, err := s.open(id, sealed)
+	if err != nil {
+		return nil, "", "", errgo.Notef(err, "cannot open %q", id)
+	}
+	return contents, contentType, encoding, nil
+}
+
+// Put implements Storage.
+func (s *EncryptedStorage) Put(id string, contents []byte, contentType string) error {
+	return s.PutOwned(id, contents, contentType, "")
+}
+
+// PutOwned implements Storage.
+func (s *EncryptedStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	sealed, err := s.seal(id, contents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.Storage.PutOwned(id, sealed, contentType, owner), errgo.Any)
+}
+
+// PutEncoded implements EncodedStorage, if the wrapped Storage does.
+func (s *EncryptedStorage) PutEncoded(id string, contents []byte, contentType string, encoding string, owner string) error {
+	if encoding == "" {
+		return s.PutOwned(id, contents, contentType, owner)
+	}
+	es, ok := s.Storage.(EncodedStorage)
+	if !ok {
+		return errgo.New("storage does not support content encodings")
+	}
+	sealed, err := s.seal(id, contents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(es.PutEncoded(id, sealed, contentType, encoding, owner), errgo.Any)
+}
+
+// CreateEncodedObject implements EncodedCreator, if the wrapped Storage
+// does.
+func (s *EncryptedStorage) CreateEncodedObject(id string, contents []byte, contentType string, encoding string, owner string, newMacaroon func(bakery.Storage) error) error {
+	if encoding == "" {
+		return s.CreateObject(id, contents, contentType, owner, newMacaroon)
+	}
+	ec, ok := s.Storage.(EncodedCreator)
+	if !ok {
+		return ErrNotAtomic
+	}
+	sealed, err := s.seal(id, contents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return ec.CreateEncodedObject(id, sealed, contentType, encoding, owner, newMacaroon)
+}
+
+// CreateObject implements AtomicCreator, if the wrapped Storage does.
+func (s *EncryptedStorage) CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error {
+	ac, ok := s.Storage.(AtomicCreator)
+	if !ok {
+		return ErrNotAtomic
+	}
+	sealed, err := s.seal(id, contents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return ac.CreateObject(id, sealed, contentType, owner, newMacaroon)
+}
+
+// seal encrypts the contents of object id under a new data key, wrapped by
+// the current master key.
+func (s *EncryptedStorage) seal(id string, contents []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	env := &envelope{keyID: s.current.ID}
+	env.wrappedKey, err = gcmSeal(s.current.Key, dataKey, []byte(id))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	env.contents, err = gcmSeal(dataKey, contents, []byte(id))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return env.marshal(), nil
+}
+
+// Rewrap wraps the data key of every object not already under the current
+// master key with the current master key, so that previous master keys may be
+// retired. Contents are not re-encrypted. The wrapped Storage must implement
+// ContentRewriter. Rewrap returns the number of objects rewrapped.
+func (s *EncryptedStorage) Rewrap() (int, error) {
+	rw, ok := s.Storage.(ContentRewriter)
+	if !ok {
+		return 0, errgo.New("storage does not support rewriting contents")
+	}
+	var n int
+	err := rw.Rewrite(func(id string, sealed []byte) ([]byte, error) {
+		env, err := parseEnvelope(sealed)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot rewrap %q", id)
+		}
+		if env.keyID == s.current.ID {
+			return nil, nil
+		}
+		dataKey, err := s.unwrap(id, env)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot rewrap %q", id)
+		}
+		env.keyID = s.current.ID
+		env.wrappedKey, err = gcmSeal(s.current.Key, dataKey, []byte(id))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		n++
+		return env.marshal(), nil
+	})
+	return n, errgo.Mask(err, errgo.Any)
+}
+
+// open decrypts the sealed contents of object id.
+func (s *EncryptedStorage) open(id string, sealed []byte) ([]byte, error) {
+	env, err := parseEnvelope(sealed)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	dataKey, err := s.unwrap(id, env)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return gcmOpen(dataKey, env.contents, []byte(id))
+}
+
+func (s *EncryptedStorage) unwrap(id string, env *envelope) ([]byte, error) {
+	masterKey, ok := s.keys[env.keyID]
+	if !ok {
+		return nil, errgo.Newf("unknown master key %q", env.keyID)
+	}
+	return gcmOpen(masterKey, env.wrappedKey, []byte(id))
+}
+
+// envelope is the form in which EncryptedStorage stores object contents.
+type envelope struct {
+	keyID      string
+	wrappedKey []byte
+	contents   []byte
+}
+
+// marshal encodes the envelope as a version byte, the length-prefixed master
+// key ID, the length-prefixed wrapped data key, then the sealed contents.
+func (env *envelope) marshal() []byte {
+	buf := make([]byte, 0, 4+len(env.keyID)+len(env.wrappedKey)+len(env.contents))
+	buf = append(buf, envelopeVersion, byte(len(env.keyID)))
+	buf = append(buf, env.keyID...)
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(env.wrappedKey)))
+	buf = append(buf, n[:]...)
+	buf = append(buf, env.wrappedKey...)
+	return append(buf, env.contents...)
+}
+
+func parseEnvelope(buf []byte) (*envelope, error) {
+	if len(buf) < 2 || buf[0] != envelopeVersion {
+		return nil, errgo.New("not an encrypted object")
+	}
+	var env envelope
+	n := int(buf[1])
+	buf = buf[2:]
+	if len(buf) < n+2 {
+		return nil, errgo.New("truncated envelope")
+	}
+	env.keyID, buf = string(buf[:n]), buf[n:]
+	n = int(binary.BigEndian.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < n {
+		return nil, errgo.New("truncated envelope")
+	}
+	env.wrappedKey, env.contents = buf[:n], buf[n:]
+	return &env, nil
+}
+
+// gcmSeal encrypts and authenticates plaintext with AES-GCM, returning the
+// random nonce followed by the ciphertext.
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// gcmOpen reverses gcmSeal.
+func gcmOpen(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errgo.New("sealed data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return cipher.NewGCM(block)
+}
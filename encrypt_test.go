@@ -0,0 +1,84 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// encryptedServiceSuite runs the service tests against storage encrypted at
+// rest.
+type encryptedServiceSuite struct {
+	serviceSuite
+	raw oostore.Storage
+}
+
+var _ = gc.Suite(&encryptedServiceSuite{})
+
+func (s *encryptedServiceSuite) SetUpTest(c *gc.C) {
+	s.raw = oostore.NewMemStorage()
+	store, err := oostore.NewEncryptedStorage(s.raw, masterKey("one"))
+	c.Assert(err, gc.IsNil)
+	s.setUpService(c, oostore.ServiceConfig{ObjectStore: store})
+}
+
+func masterKey(id string) oostore.MasterKey {
+	return oostore.MasterKey{ID: id, Key: bytes.Repeat([]byte(id[:1]), oostore.MasterKeySize)}
+}
+
+func (s *encryptedServiceSuite) TestRewrap(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	id := path.Base(resp.Header.Get("Location"))
+
+	// Contents are not stored in the clear.
+	sealed, contentType, err := s.raw.Get(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Contains(sealed, []byte("hunter2")), gc.Equals, false)
+	c.Assert(contentType, gc.Equals, "something/something")
+
+	// Rotate to a new master key, keeping the old one to open existing
+	// objects until they are rewrapped.
+	rotated, err := oostore.NewEncryptedStorage(s.raw, masterKey("two"), masterKey("one"))
+	c.Assert(err, gc.IsNil)
+	n, err := rotated.Rewrap()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	n, err = rotated.Rewrap()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	// The old master key is no longer needed.
+	retired, err := oostore.NewEncryptedStorage(s.raw, masterKey("two"))
+	c.Assert(err, gc.IsNil)
+	contents, _, err := retired.Get(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "hunter2")
+	old, err := oostore.NewEncryptedStorage(s.raw, masterKey("one"))
+	c.Assert(err, gc.IsNil)
+	_, _, err = old.Get(id)
+	c.Assert(err, gc.ErrorMatches, `cannot open .*: unknown master key "two"`)
+}
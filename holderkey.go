@@ -0,0 +1,263 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// condHolderKey is the condition of caveats which bind a macaroon to the
+// holder of an Ed25519 private key, who must sign each request made with
+// it.
+const condHolderKey = "holder-key"
+
+// HolderSignatureHeader is the request header in which the holder of a
+// macaroon bound to their key gives their signature of the request.
+const HolderSignatureHeader = "Oostore-Holder-Signature"
+
+// maxHolderSignatureAge is how far the time a request was signed at may be
+// from the time on the server, either way.
+const maxHolderSignatureAge = 5 * time.Minute
+
+// HolderKeyCaveat returns a caveat which binds a macaroon to the holder of
+// the private key of pub.
+func HolderKeyCaveat(pub ed25519.PublicKey) string {
+	return condHolderKey + " " + base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// SignRequest signs a request authorized by m, which is bound to key with a
+// holder-key caveat, adding the signature to the request header. The
+// signature covers the request method, host, path, query and body, the
+// time, a random nonce and the signature of m, so it can't be used with
+// another macaroon, nor for long. Each signature is only accepted once.
+// Requests authorized by more than one macaroon bound to a key are signed
+// for each.
+func SignRequest(req *http.Request, m *macaroon.Macaroon, key ed25519.PrivateKey) error {
+	body, err := requestBody(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot read request body")
+	}
+	var nonceBytes [16]byte
+	_, err = rand.Read(nonceBytes[:])
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes[:])
+	t := time.Now().UTC().Format(time.RFC3339)
+	sig := ed25519.Sign(key, holderSignedMessage(req, body, t, nonce, m.Signature()))
+	req.Header.Add(HolderSignatureHeader, t+" "+nonce+" "+base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// requestBody returns the body of a request to be sent, leaving it to be
+// sent.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// holderSignedMessage returns the message signed by the holder of a
+// macaroon with the given signature, to make the request with the given
+// body at time t. The nonce makes the signatures of identical requests made
+// at the same time differ, so that each may be used once.
+func holderSignedMessage(r *http.Request, body []byte, t string, nonce string, macaroonSig []byte) []byte {
+	digest := sha256.Sum256(body)
+	host := r.Host
+	if host == "" {
+		// Requests to be sent may leave the host to their URL.
+		host = r.URL.Host
+	}
+	return []byte(strings.Join([]string{
+		"oostore-holder-signature",
+		r.Method,
+		host,
+		r.URL.RequestURI(),
+		t,
+		nonce,
+		hex.EncodeToString(macaroonSig),
+		hex.EncodeToString(digest[:]),
+	}, "\n"))
+}
+
+// parseHolderKey parses an Ed25519 public key, as given in a holder-key
+// caveat.
+func parseHolderKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key %q", s)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// holderKeyChecker checks that the request carries a recent signature by
+// the key given in a holder-key caveat, of the request made with the
+// macaroon being checked. The signatures accepted are collected in check,
+// to be marked as used once the macaroon has been verified.
+func holderKeyChecker(r *http.Request, check *holderSignatureCheck) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condHolderKey,
+		Check_: func(_, cav string) error {
+			key, err := parseHolderKey(cav)
+			if err != nil {
+				return err
+			}
+			for _, field := range r.Header[HolderSignatureHeader] {
+				u, err := verifyHolderSignature(r, check.body, field, key, check.macaroonSig)
+				if err == nil {
+					check.used = append(check.used, u)
+					return nil
+				}
+			}
+			return errgo.Newf("no valid %s for the holder key", HolderSignatureHeader)
+		},
+	}
+}
+
+// verifyHolderSignature verifies a holder signature given in the request
+// header, and returns it as it is to be marked used.
+func verifyHolderSignature(r *http.Request, body []byte, field string, key ed25519.PublicKey, macaroonSig []byte) (usedSignature, error) {
+	parts := strings.Fields(field)
+	if len(parts) != 3 {
+		return usedSignature{}, errgo.New("invalid signature")
+	}
+	t, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return usedSignature{}, errgo.Mask(err)
+	}
+	if age := time.Since(t); age > maxHolderSignatureAge || age < -maxHolderSignatureAge {
+		return usedSignature{}, errgo.New("signature expired")
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return usedSignature{}, errgo.Mask(err)
+	}
+	if !ed25519.Verify(key, holderSignedMessage(r, body, parts[0], parts[1], macaroonSig), sig) {
+		return usedSignature{}, errgo.New("signature mismatch")
+	}
+	// Signatures are remembered by their bytes, rather than as given, so
+	// that they can't be replayed encoded differently.
+	return usedSignature{
+		sig:     string(sig),
+		expires: t.Add(maxHolderSignatureAge),
+	}, nil
+}
+
+// holderSignatureCheck collects the holder signatures accepted while
+// checking a macaroon.
+type holderSignatureCheck struct {
+	// macaroonSig is the signature of the macaroon being checked.
+	macaroonSig []byte
+
+	// body is the body of the request.
+	body []byte
+
+	used []usedSignature
+}
+
+// usedSignature is a holder signature, which may not be used again until
+// it has expired.
+type usedSignature struct {
+	sig     string
+	expires time.Time
+}
+
+// errSignatureReplayed is the cause of errors refusing requests with a
+// holder signature which has been used before.
+var errSignatureReplayed = fmt.Errorf("holder signature already used")
+
+// holderSignatureCache remembers the holder signatures which have been
+// used, until they expire, so that each is only accepted once.
+type holderSignatureCache struct {
+	mu    sync.Mutex
+	used  map[string]time.Time
+	swept time.Time
+}
+
+func newHolderSignatureCache() *holderSignatureCache {
+	return &holderSignatureCache{
+		used:  make(map[string]time.Time),
+		swept: time.Now(),
+	}
+}
+
+// use marks the given signatures as used, and returns nil if none of them
+// had been used before. Otherwise none are marked, and the cause of the
+// error is errSignatureReplayed. If dryRun is set, the signatures are only
+// checked.
+func (c *holderSignatureCache) use(sigs []usedSignature, dryRun bool) error {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+	for _, u := range sigs {
+		if _, ok := c.used[u.sig]; ok {
+			return errgo.WithCausef(nil, errSignatureReplayed, "")
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	for _, u := range sigs {
+		c.used[u.sig] = u.expires
+	}
+	return nil
+}
+
+// sweep forgets the signatures which have expired, as they would not be
+// accepted again anyway.
+func (c *holderSignatureCache) sweep(now time.Time) {
+	if now.Sub(c.swept) < sweepInterval {
+		return
+	}
+	for sig, expires := range c.used {
+		if now.After(expires) {
+			delete(c.used, sig)
+		}
+	}
+	c.swept = now
+}
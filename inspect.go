@@ -0,0 +1,234 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// Inspection describes what a macaroon permits, as reported by the inspect
+// endpoint.
+type Inspection struct {
+	// Id is the identifier of the macaroon.
+	Id string `json:"id"`
+
+	// Object is the object ID the macaroon is restricted to, if any.
+	Object string `json:"object,omitempty"`
+
+	// Collection is the collection the macaroon is restricted to, if any.
+	Collection string `json:"collection,omitempty"`
+
+	// Operations are the operations the macaroon allows.
+	Operations []string `json:"operations"`
+
+	// Expires is the earliest time-before restriction, if any.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// NotBefore is the latest time-after restriction, if any.
+	NotBefore *time.Time `json:"not-before,omitempty"`
+
+	// TimeWindows are the recurring windows of time the macaroon is
+	// restricted to. The time must be within every one of them.
+	TimeWindows []string `json:"time-windows,omitempty"`
+
+	// RateLimits are the limits on the requests the macaroon may
+	// authorize, each counted separately.
+	RateLimits []string `json:"rate-limits,omitempty"`
+
+	// ClientIPAddrs are the client addresses the macaroon is restricted
+	// to. All of them must match, so more than one will never verify.
+	ClientIPAddrs []string `json:"client-ip-addrs,omitempty"`
+
+	// ClientIPCIDRs are the lists of networks the client address is
+	// restricted to, one list for each client-ip-cidr caveat. The address
+	// must be within a network of every list.
+	ClientIPCIDRs []string `json:"client-ip-cidrs,omitempty"`
+
+	// ClientCerts are the SHA-256 fingerprints of the TLS client
+	// certificates the macaroon is bound to. All of them must match, so
+	// more than one will never verify.
+	ClientCerts []string `json:"client-certs,omitempty"`
+
+	// HolderKeys are the public keys of the holders the macaroon is bound
+	// to, who must sign requests made with it. All of them must sign.
+	HolderKeys []string `json:"holder-keys,omitempty"`
+
+	// Origins are the lists of origins requests are restricted to, one
+	// list for each origin caveat. The Origin header must match an origin
+	// of every list.
+	Origins []string `json:"origins,omitempty"`
+
+	// RefererPrefixes are the URLs the Referer header of requests must
+	// begin with. All of them must match.
+	RefererPrefixes []string `json:"referer-prefixes,omitempty"`
+
+	// Headers are the request headers required, as Name=value.
+	Headers []string `json:"headers,omitempty"`
+
+	// ContentTypes are the lists of media ranges the content type of
+	// fetched objects is restricted to, one list for each content-type
+	// caveat. The content type must match a range of every list.
+	ContentTypes []string `json:"content-types,omitempty"`
+
+	// ThirdParty are the locations of third-party caveats which must be
+	// discharged.
+	ThirdParty []string `json:"third-party,omitempty"`
+
+	// ObjectKey reports whether the macaroon carries the key the object's
+	// contents are encrypted with.
+	ObjectKey bool `json:"object-key,omitempty"`
+
+	// Caveats are all the first-party caveats on the macaroon, except that
+	// object keys are omitted.
+	Caveats []string `json:"caveats"`
+
+	// Verified reports, by operation, whether the macaroon would currently
+	// authorize a request from this client. Reasons for any failures are
+	// given in Errors.
+	Verified map[string]bool   `json:"verified"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// inspectMacaroons summarizes the caveats on ms.
+func inspectMacaroons(ms macaroon.Slice) *Inspection {
+	allowed := make(map[string]bool)
+	for op := range operations {
+		allowed[op] = true
+	}
+	insp := &Inspection{
+		Id:       ms[0].Id(),
+		Caveats:  []string{},
+		Verified: make(map[string]bool),
+	}
+	for _, cav := range ms[0].Caveats() {
+		if cav.Location != "" {
+			insp.ThirdParty = append(insp.ThirdParty, cav.Location)
+			continue
+		}
+		insp.Caveats = append(insp.Caveats, redactCaveat(cav.Id))
+		cond, arg, err := checkers.ParseCaveat(cav.Id)
+		if err != nil {
+			continue
+		}
+		switch cond {
+		case condObjectKey:
+			insp.ObjectKey = true
+		case condObject:
+			if insp.Object == "" {
+				insp.Object = arg
+			}
+		case condCollection:
+			if insp.Collection == "" {
+				insp.Collection = arg
+			}
+		case condOperation:
+			ops := make(map[string]bool)
+			for _, op := range strings.Split(arg, ",") {
+				ops[strings.TrimSpace(strings.ToLower(op))] = true
+			}
+			for op := range allowed {
+				if !ops[op] {
+					delete(allowed, op)
+				}
+			}
+		case "time-before":
+			t, err := time.Parse(time.RFC3339, arg)
+			if err == nil && (insp.Expires == nil || t.Before(*insp.Expires)) {
+				insp.Expires = &t
+			}
+		case condTimeAfter:
+			t, err := time.Parse(time.RFC3339, arg)
+			if err == nil && (insp.NotBefore == nil || t.After(*insp.NotBefore)) {
+				insp.NotBefore = &t
+			}
+		case "client-ip-addr":
+			insp.ClientIPAddrs = append(insp.ClientIPAddrs, arg)
+		case condClientIPCIDR:
+			insp.ClientIPCIDRs = append(insp.ClientIPCIDRs, arg)
+		case condClientCertSHA256:
+			insp.ClientCerts = append(insp.ClientCerts, arg)
+		case condTimeWindow:
+			insp.TimeWindows = append(insp.TimeWindows, arg)
+		case condRateLimit:
+			insp.RateLimits = append(insp.RateLimits, arg)
+		case condOrigin:
+			insp.Origins = append(insp.Origins, arg)
+		case condRefererPrefix:
+			insp.RefererPrefixes = append(insp.RefererPrefixes, arg)
+		case condHeader:
+			insp.Headers = append(insp.Headers, arg)
+		case condHolderKey:
+			insp.HolderKeys = append(insp.HolderKeys, arg)
+		case condContentType:
+			insp.ContentTypes = append(insp.ContentTypes, arg)
+		}
+	}
+	insp.Operations = []string{}
+	for op := range allowed {
+		insp.Operations = append(insp.Operations, op)
+	}
+	sort.Strings(insp.Operations)
+	return insp
+}
+
+// inspect handles the request to describe what a macaroon permits, and
+// whether it would currently verify, without performing any operation.
+func (s *Service) inspect(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var ms macaroon.Slice
+	body, err := readJSON(r, &ms)
+	if err != nil {
+		httpErrorf(w, http.StatusBadRequest, errgo.Notef(err, "invalid request"))
+		return
+	}
+	if len(ms) == 0 {
+		httpErrorf(w, http.StatusBadRequest, errgo.New("no macaroon to inspect"))
+		return
+	}
+
+	insp := inspectMacaroons(ms)
+	targets := map[string]string{
+		"object":     insp.Object,
+		"collection": insp.Collection,
+	}
+	for op, param := range operations {
+		p := httprouter.Params{{Key: param, Value: targets[param]}}
+		_, err := s.checkMacaroons(ms, requestInfo{request: r, params: p, operation: op, dryRun: true, body: body})
+		insp.Verified[op] = err == nil
+		if err != nil {
+			if insp.Errors == nil {
+				insp.Errors = make(map[string]string)
+			}
+			insp.Errors[op] = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(insp)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
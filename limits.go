@@ -0,0 +1,91 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Limits restricts the size of objects and how much may be stored. Zero
+// values are unlimited.
+type Limits struct {
+	// MaxObjectSize is the largest object that may be created, in bytes.
+	MaxObjectSize int64
+
+	// Quota is the most that may be stored in total, in bytes.
+	Quota int64
+
+	// OwnerQuota is the most that each owner may store, in bytes.
+	OwnerQuota int64
+}
+
+// errTooLarge is the cause of errors refusing objects which are larger than
+// allowed.
+var errTooLarge = fmt.Errorf("too large")
+
+// readObject reads the contents of a new object from the request body. The
+// body is not read beyond the maximum object size, so that a client can't
+// make the service buffer more than that.
+func (s *Service) readObject(r *http.Request) ([]byte, error) {
+	max := s.limits.MaxObjectSize
+	if max <= 0 {
+		contents, err := ioutil.ReadAll(r.Body)
+		return contents, errgo.Mask(err)
+	}
+	if r.ContentLength > max {
+		return nil, errgo.WithCausef(nil, errTooLarge, "object exceeds maximum size of %d bytes", max)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if int64(len(contents)) > max {
+		return nil, errgo.WithCausef(nil, errTooLarge, "object exceeds maximum size of %d bytes", max)
+	}
+	return contents, nil
+}
+
+// checkQuota returns an error with the cause errTooLarge if storing size
+// more bytes for owner would exceed a quota. Usage is checked before the
+// object is stored, so objects created concurrently may together exceed a
+// quota by up to the size of each.
+func (s *Service) checkQuota(owner string, size int64) error {
+	if s.limits.Quota > 0 {
+		usage, err := s.store.Usage("")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if usage+size > s.limits.Quota {
+			return errgo.WithCausef(nil, errTooLarge, "storage quota exceeded")
+		}
+	}
+	if s.limits.OwnerQuota > 0 && owner != "" {
+		usage, err := s.store.Usage(owner)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if usage+size > s.limits.OwnerQuota {
+			return errgo.WithCausef(nil, errTooLarge, "owner quota exceeded")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// limitsServiceSuite tests a service which limits object sizes and
+// storage quotas. It does not run the other service tests, which store
+// larger objects.
+type limitsServiceSuite struct {
+	svc serviceSuite
+}
+
+var _ = gc.Suite(&limitsServiceSuite{})
+
+func (s *limitsServiceSuite) SetUpTest(c *gc.C) {
+	s.svc.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		Limits: oostore.Limits{
+			MaxObjectSize: 4,
+			Quota:         10,
+			OwnerQuota:    6,
+		},
+	})
+}
+
+func (s *limitsServiceSuite) TearDownTest(c *gc.C) {
+	s.svc.TearDownTest(c)
+}
+
+func (s *limitsServiceSuite) create(c *gc.C, contents string, ownerAuth []byte) int {
+	req, err := http.NewRequest("POST", s.svc.server.URL, bytes.NewBufferString(contents))
+	c.Assert(err, gc.IsNil)
+	if ownerAuth != nil {
+		req.Header.Set("Oostore-Owner", base64.StdEncoding.EncodeToString(ownerAuth))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *limitsServiceSuite) TestMaxObjectSize(c *gc.C) {
+	c.Assert(s.create(c, "aaaa", nil), gc.Equals, http.StatusOK)
+	c.Assert(s.create(c, "bbbbb", nil), gc.Equals, http.StatusRequestEntityTooLarge)
+
+	// Without a content length, the body is only read up to the limit.
+	req, err := http.NewRequest("POST", s.svc.server.URL, ioutil.NopCloser(strings.NewReader("ccccc")))
+	c.Assert(err, gc.IsNil)
+	c.Assert(req.ContentLength, gc.Equals, int64(0))
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+
+	usage, err := s.svc.store.Usage("")
+	c.Assert(err, gc.IsNil)
+	c.Assert(usage, gc.Equals, int64(4))
+}
+
+func (s *limitsServiceSuite) TestQuota(c *gc.C) {
+	resp, err := http.Post(s.svc.server.URL+"/_/owner", "application/json", bytes.NewBuffer(nil))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	ownerAuth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(s.create(c, "aaaa", ownerAuth), gc.Equals, http.StatusOK)
+	// The owner quota is exceeded, but not the total.
+	c.Assert(s.create(c, "bbb", ownerAuth), gc.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(s.create(c, "bb", ownerAuth), gc.Equals, http.StatusOK)
+	c.Assert(s.create(c, "ccc", nil), gc.Equals, http.StatusOK)
+	// The total quota is exceeded.
+	c.Assert(s.create(c, "dd", nil), gc.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(s.create(c, "d", nil), gc.Equals, http.StatusOK)
+}
@@ -17,12 +17,20 @@
 package oostore
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
 )
 
 type contentDoc struct {
 	ContentType string
+	Encoding    string
 	Contents    []byte
+	Owner       string
+	Created     time.Time
 }
 
 type memStorage struct {
@@ -34,31 +42,63 @@ type memStorage struct {
 // memory. Primarily useful for testing. Ephemeral storage for production use
 // would probably want to cap memory usage, implement some kind of expiration
 // policy, etc.
-func NewMemStorage() memStorage {
-	return memStorage{m: make(map[string]contentDoc)}
+func NewMemStorage() *memStorage {
+	return &memStorage{m: make(map[string]contentDoc)}
 }
 
 // Get implements Storage.
-func (s memStorage) Get(id string) ([]byte, string, error) {
+func (s *memStorage) Get(id string) ([]byte, string, error) {
+	contents, contentType, encoding, err := s.GetEncoded(id)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = DecodeContents(contents, encoding)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot decode %q", id)
+	}
+	return contents, contentType, nil
+}
+
+// GetEncoded implements EncodedGetter.
+func (s *memStorage) GetEncoded(id string) ([]byte, string, string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	doc, ok := s.m[id]
 	if !ok {
-		return nil, "", ErrNotFound
+		return nil, "", "", ErrNotFound
 	}
-	return doc.Contents, doc.ContentType, nil
+	return doc.Contents, doc.ContentType, doc.Encoding, nil
 }
 
 // Put implements Storage.
-func (s memStorage) Put(id string, contents []byte, contentType string) error {
+func (s *memStorage) Put(id string, contents []byte, contentType string) error {
+	return s.PutOwned(id, contents, contentType, "")
+}
+
+// PutOwned implements Storage.
+func (s *memStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	return s.PutEncoded(id, contents, contentType, "", owner)
+}
+
+// PutEncoded implements EncodedStorage.
+func (s *memStorage) PutEncoded(id string, contents []byte, contentType string, encoding string, owner string) error {
 	s.mu.Lock()
-	s.m[id] = contentDoc{Contents: contents, ContentType: contentType}
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[id]; ok {
+		return fmt.Errorf("object %q already exists", id)
+	}
+	s.m[id] = contentDoc{
+		Contents:    contents,
+		ContentType: contentType,
+		Encoding:    encoding,
+		Owner:       owner,
+		Created:     time.Now().UTC(),
+	}
 	return nil
 }
 
 // Delete implements Storage.
-func (s memStorage) Delete(id string) error {
+func (s *memStorage) Delete(id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	_, ok := s.m[id]
@@ -68,3 +108,127 @@ func (s memStorage) Delete(id string) error {
 	delete(s.m, id)
 	return nil
 }
+
+// Rewrite implements ContentRewriter.
+func (s *memStorage) Rewrite(f func(id string, contents []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, doc := range s.m {
+		contents, err := f(id, doc.Contents)
+		if err != nil {
+			return err
+		}
+		if contents != nil {
+			doc.Contents = contents
+			s.m[id] = doc
+		}
+	}
+	return nil
+}
+
+// List implements Storage.
+func (s *memStorage) List(owner string, after string, limit int) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, doc := range s.m {
+		if owner != "" && doc.Owner == owner && id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	var result []ObjectInfo
+	for _, id := range ids {
+		doc := s.m[id]
+		result = append(result, ObjectInfo{
+			ID:          id,
+			ContentType: doc.ContentType,
+			Size:        int64(len(doc.Contents)),
+			Created:     doc.Created,
+		})
+	}
+	return result, nil
+}
+
+// Usage implements Storage.
+func (s *memStorage) Usage(owner string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for _, doc := range s.m {
+		if owner == "" || doc.Owner == owner {
+			total += int64(len(doc.Contents))
+		}
+	}
+	return total, nil
+}
+
+type memCollectionStorage struct {
+	mu sync.Mutex
+	m  map[string]map[string]bool
+}
+
+// NewMemCollectionStorage returns a new collection storage implementation
+// that only keeps things in memory. Primarily useful for testing.
+func NewMemCollectionStorage() *memCollectionStorage {
+	return &memCollectionStorage{m: make(map[string]map[string]bool)}
+}
+
+// Create implements CollectionStorage.
+func (s *memCollectionStorage) Create(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[id]; ok {
+		return fmt.Errorf("collection %q already exists", id)
+	}
+	s.m[id] = make(map[string]bool)
+	return nil
+}
+
+// Add implements CollectionStorage.
+func (s *memCollectionStorage) Add(id string, objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, ok := s.m[id]
+	if !ok {
+		return ErrNotFound
+	}
+	members[objectID] = true
+	return nil
+}
+
+// Members implements CollectionStorage.
+func (s *memCollectionStorage) Members(id string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, ok := s.m[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var result []string
+	for objectID := range members {
+		result = append(result, objectID)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// HasMember implements CollectionStorage.
+func (s *memCollectionStorage) HasMember(id string, objectID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[id][objectID], nil
+}
+
+// RemoveObject implements CollectionStorage.
+func (s *memCollectionStorage) RemoveObject(objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, members := range s.m {
+		delete(members, objectID)
+	}
+	return nil
+}
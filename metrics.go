@@ -0,0 +1,259 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+)
+
+const metricsNamespace = "oostore"
+
+// Metrics collects Prometheus metrics about a Service and its object
+// storage. A nil *Metrics collects nothing.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	authFailures    *prometheus.CounterVec
+	bytesStored     prometheus.Counter
+	bytesServed     prometheus.Counter
+	storageDuration *prometheus.HistogramVec
+	handler         http.Handler
+}
+
+// NewMetrics returns new Metrics, registered in a registry of their own
+// along with the standard Go runtime and process metrics.
+func NewMetrics() (*Metrics, error) {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "HTTP requests handled, by route and status code.",
+		}, []string{"route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_failures_total",
+			Help:      "Requests refused for want of authorization, by reason.",
+		}, []string{"reason"}),
+		bytesStored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stored_bytes_total",
+			Help:      "Bytes of object contents stored, as received from clients.",
+		}),
+		bytesServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "served_bytes_total",
+			Help:      "Bytes of object contents served, as sent to clients.",
+		}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_duration_seconds",
+			Help:      "Time taken by object storage calls, by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op"}),
+	}
+	for _, c := range []prometheus.Collector{
+		m.requests,
+		m.requestDuration,
+		m.authFailures,
+		m.bytesStored,
+		m.bytesServed,
+		m.storageDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	} {
+		err := m.registry.Register(c)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m, nil
+}
+
+// ServeHTTP implements net/http.Handler, serving the metrics in the
+// Prometheus exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// Reasons for authorization failures.
+const (
+	authFailureInvalidRequest = "invalid-request"
+	authFailureNoMacaroons    = "no-macaroons"
+	authFailureVerification   = "verification-failed"
+	authFailureObjectKey      = "invalid-object-key"
+	authFailureRateLimited    = "rate-limited"
+	authFailureContentType    = "content-type"
+	authFailureReplayed       = "replayed-signature"
+	authFailureNoOwner        = "no-owner"
+	authFailureError          = "error"
+)
+
+func (m *Metrics) authFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) stored(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesStored.Add(float64(n))
+}
+
+func (m *Metrics) served(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesServed.Add(float64(n))
+}
+
+// instrument returns h, counting and timing the requests it handles under
+// the given route name.
+func (m *Metrics) instrument(route string, h httprouter.Handle) httprouter.Handle {
+	if m == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h(sw, r, p)
+		m.requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(route, strconv.Itoa(sw.code)).Inc()
+	}
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// instrumentStorage returns store, timing the calls made to it. The
+// optional interfaces implemented by store are preserved.
+func (m *Metrics) instrumentStorage(store Storage) Storage {
+	if m == nil || store == nil {
+		return store
+	}
+	is := &instrumentedStorage{Storage: store, metrics: m}
+	if _, ok := store.(EncodedGetter); ok {
+		return &instrumentedEncodedStorage{is}
+	}
+	return is
+}
+
+func (m *Metrics) observeStorage(op string, start time.Time) {
+	m.storageDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedStorage times the calls made to the Storage it wraps.
+type instrumentedStorage struct {
+	Storage
+	metrics *Metrics
+}
+
+// Get implements Storage.
+func (s *instrumentedStorage) Get(id string) ([]byte, string, error) {
+	defer s.metrics.observeStorage("get", time.Now())
+	return s.Storage.Get(id)
+}
+
+// Put implements Storage.
+func (s *instrumentedStorage) Put(id string, contents []byte, contentType string) error {
+	defer s.metrics.observeStorage("put", time.Now())
+	return s.Storage.Put(id, contents, contentType)
+}
+
+// PutOwned implements Storage.
+func (s *instrumentedStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	defer s.metrics.observeStorage("put", time.Now())
+	return s.Storage.PutOwned(id, contents, contentType, owner)
+}
+
+// Delete implements Storage.
+func (s *instrumentedStorage) Delete(id string) error {
+	defer s.metrics.observeStorage("delete", time.Now())
+	return s.Storage.Delete(id)
+}
+
+// List implements Storage.
+func (s *instrumentedStorage) List(owner string, after string, limit int) ([]ObjectInfo, error) {
+	defer s.metrics.observeStorage("list", time.Now())
+	return s.Storage.List(owner, after, limit)
+}
+
+// Usage implements Storage.
+func (s *instrumentedStorage) Usage(owner string) (int64, error) {
+	defer s.metrics.observeStorage("usage", time.Now())
+	return s.Storage.Usage(owner)
+}
+
+// CreateObject implements AtomicCreator, if the wrapped Storage does.
+func (s *instrumentedStorage) CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error {
+	ac, ok := s.Storage.(AtomicCreator)
+	if !ok {
+		return ErrNotAtomic
+	}
+	defer s.metrics.observeStorage("create", time.Now())
+	return ac.CreateObject(id, contents, contentType, owner, newMacaroon)
+}
+
+// instrumentedEncodedStorage times the calls made to Storage which is also
+// an EncodedGetter.
+type instrumentedEncodedStorage struct {
+	*instrumentedStorage
+}
+
+// GetEncoded implements EncodedGetter.
+func (s *instrumentedEncodedStorage) GetEncoded(id string) ([]byte, string, string, error) {
+	defer s.metrics.observeStorage("get", time.Now())
+	return s.Storage.(EncodedGetter).GetEncoded(id)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// metricsServiceSuite runs the service tests while collecting metrics.
+type metricsServiceSuite struct {
+	serviceSuite
+	metrics *oostore.Metrics
+}
+
+var _ = gc.Suite(&metricsServiceSuite{})
+
+func (s *metricsServiceSuite) SetUpTest(c *gc.C) {
+	var err error
+	s.metrics, err = oostore.NewMetrics()
+	c.Assert(err, gc.IsNil)
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		Metrics:     s.metrics,
+	})
+}
+
+func (s *metricsServiceSuite) scrape(c *gc.C) string {
+	rec := httptest.NewRecorder()
+	s.metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	return rec.Body.String()
+}
+
+func (s *metricsServiceSuite) TestMetrics(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for i := 0; i < 2; i++ {
+		resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(auth))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	}
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBufferString("nope"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(withCaveat(c, auth, "operation delete")))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+	// Inspecting a macaroon is not a refused request, whatever operations
+	// it would fail.
+	resp, err = cl.Post(s.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(withCaveat(c, auth, "operation delete")))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	// Refused owner and collection macaroons are counted too.
+	for i, owner := range []string{"nope", base64.StdEncoding.EncodeToString(auth)} {
+		req, err := http.NewRequest("POST", s.server.URL, bytes.NewBufferString("hunter2"))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Oostore-Owner", owner)
+		resp, err = cl.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden, gc.Commentf("owner#%d", i))
+	}
+	addReq, err := json.Marshal(map[string]json.RawMessage{"collection": auth, "object": auth})
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("PUT", s.server.URL+"/_/collection/nope"+loc, bytes.NewBuffer(addReq))
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+
+	req, err = http.NewRequest("DELETE", s.server.URL+loc, bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent)
+
+	metrics := s.scrape(c)
+	for _, line := range []string{
+		`oostore_requests_total{code="200",route="create"} 1`,
+		`oostore_requests_total{code="200",route="fetch"} 2`,
+		`oostore_requests_total{code="403",route="fetch"} 2`,
+		`oostore_requests_total{code="204",route="delete"} 1`,
+		`oostore_request_duration_seconds_count{route="fetch"} 4`,
+		`oostore_auth_failures_total{reason="invalid-request"} 2`,
+		`oostore_auth_failures_total{reason="verification-failed"} 3`,
+		`oostore_stored_bytes_total 7`,
+		`oostore_served_bytes_total 14`,
+		`oostore_storage_duration_seconds_count{op="put"} 1`,
+		`oostore_storage_duration_seconds_count{op="get"} 2`,
+		`oostore_storage_duration_seconds_count{op="delete"} 1`,
+	} {
+		c.Check(strings.Contains(metrics, line+"\n"), gc.Equals, true, gc.Commentf("missing %q", line))
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// condObjectKey is the caveat condition carrying the key an object's
+// contents are encrypted with, when the service binds object keys to
+// macaroons.
+const condObjectKey = "object-key"
+
+// objectKeySize is the size of an object key in bytes, for AES-256.
+const objectKeySize = 32
+
+// newObjectKey returns a new random object key.
+func newObjectKey() ([]byte, error) {
+	key := make([]byte, objectKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// objectKeyCaveat returns a caveat carrying key.
+func objectKeyCaveat(key []byte) checkers.Caveat {
+	return checkers.Caveat{
+		Condition: fmt.Sprintf("%s %s", condObjectKey, base64.URLEncoding.EncodeToString(key)),
+	}
+}
+
+func parseObjectKey(arg string) ([]byte, error) {
+	key, err := base64.URLEncoding.DecodeString(arg)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid object key")
+	}
+	if len(key) != objectKeySize {
+		return nil, errgo.Newf("object key must be %d bytes", objectKeySize)
+	}
+	return key, nil
+}
+
+// objectKey returns the key carried by the first object-key caveat on the
+// primary macaroon in ms, or nil if there is none. Only the first is used,
+// because caveats added by a holder always follow those added when the
+// macaroon was created.
+func objectKey(ms macaroon.Slice) ([]byte, error) {
+	if len(ms) == 0 {
+		return nil, nil
+	}
+	for _, cav := range ms[0].Caveats() {
+		if cav.Location != "" {
+			continue
+		}
+		cond, arg, err := checkers.ParseCaveat(cav.Id)
+		if err != nil || cond != condObjectKey {
+			continue
+		}
+		return parseObjectKey(arg)
+	}
+	return nil, nil
+}
+
+// redactCaveat returns the first-party caveat cav as it may be shown or
+// recorded, without any object key it carries.
+func redactCaveat(cav string) string {
+	cond, _, err := checkers.ParseCaveat(cav)
+	if err == nil && cond == condObjectKey {
+		return condObjectKey
+	}
+	return cav
+}
+
+// objectKeyChecker checks "object-key" caveats. These carry data rather
+// than restrict the request, so any well-formed key is satisfied; a wrong
+// key only fails when the contents are opened.
+func objectKeyChecker() checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condObjectKey,
+		Check_: func(_, cav string) error {
+			_, err := parseObjectKey(cav)
+			return err
+		},
+	}
+}
+
+// sealObject encrypts the contents of object id with key.
+func sealObject(key []byte, id string, contents []byte) ([]byte, error) {
+	return gcmSeal(key, contents, []byte(id))
+}
+
+// openObject decrypts the contents of object id with key.
+func openObject(key []byte, id string, sealed []byte) ([]byte, error) {
+	return gcmOpen(key, sealed, []byte(id))
+}
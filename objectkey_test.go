@@ -0,0 +1,123 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// objectKeyServiceSuite tests a service which binds object keys to
+// macaroons. It does not run the other service tests, which expect the
+// macaroons the service issues to have no other caveats.
+type objectKeyServiceSuite struct {
+	svc serviceSuite
+}
+
+var _ = gc.Suite(&objectKeyServiceSuite{})
+
+func (s *objectKeyServiceSuite) SetUpTest(c *gc.C) {
+	s.svc.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		ObjectKeys:  true,
+	})
+}
+
+func (s *objectKeyServiceSuite) TearDownTest(c *gc.C) {
+	s.svc.TearDownTest(c)
+}
+
+func (s *objectKeyServiceSuite) TestObjectKey(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.svc.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	// The service does not store the contents in the clear.
+	sealed, _, err := s.svc.store.Get(path.Base(loc))
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Contains(sealed, []byte("hunter2")), gc.Equals, false)
+
+	// The macaroon carries the key, so an attenuated one still works.
+	resp, err = cl.Post(s.svc.server.URL+loc, "application/json",
+		bytes.NewBuffer(withCaveat(c, mjson.Bytes(), "operation fetch")))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var contents bytes.Buffer
+	_, err = io.Copy(&contents, resp.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(contents.String(), gc.Equals, "hunter2")
+
+	// The key is not disclosed by inspection.
+	resp, err = cl.Post(s.svc.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(mjson.Bytes()))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var insp oostore.Inspection
+	c.Assert(json.NewDecoder(resp.Body).Decode(&insp), gc.IsNil)
+	c.Assert(insp.ObjectKey, gc.Equals, true)
+	c.Assert(insp.Caveats, gc.DeepEquals, []string{"object " + path.Base(loc), "object-key"})
+}
+
+func (s *objectKeyServiceSuite) TestCollectionRefused(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.svc.server.URL, "something/something", bytes.NewBufferString("a"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	var objectAuth bytes.Buffer
+	_, err = io.Copy(&objectAuth, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	resp, err = cl.Post(s.svc.server.URL+"/_/collection", "application/json", bytes.NewBuffer(nil))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	collLoc := resp.Header.Get("Location")
+	var collAuth bytes.Buffer
+	_, err = io.Copy(&collAuth, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	// Objects the service can't decrypt can't be shared through a
+	// collection.
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(map[string]json.RawMessage{
+		"collection": collAuth.Bytes(),
+		"object":     objectAuth.Bytes(),
+	})
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("PUT", s.svc.server.URL+collLoc+loc, &buf)
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// ownerHeader is the request header in which an owner macaroon may be given
+// when creating an object, as base64-encoded JSON.
+const ownerHeader = "Oostore-Owner"
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// inventoryResponse is the JSON response to a request to list the objects
+// created by an owner.
+type inventoryResponse struct {
+	Objects []ObjectInfo `json:"objects"`
+
+	// Next is the value of the "after" parameter to use to get the next
+	// page of objects, if there may be more.
+	Next string `json:"next,omitempty"`
+}
+
+// checkOwner checks the owner macaroon given in the request header for the
+// given operation, returning the owner identity it declares. The check is
+// added to the audit record rec, if it is not nil.
+func (s *Service) checkOwner(r *http.Request, body []byte, op string, rec *AuditRecord) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(r.Header.Get(ownerHeader))
+	if err != nil {
+		s.metrics.authFailure(authFailureInvalidRequest)
+		return "", errgo.Notef(err, "invalid %s header", ownerHeader)
+	}
+	var ms macaroon.Slice
+	err = json.Unmarshal(buf, &ms)
+	if err != nil {
+		s.metrics.authFailure(authFailureInvalidRequest)
+		return "", errgo.Notef(err, "invalid %s header", ownerHeader)
+	}
+	return s.checkOwnerMacaroons(ms, r, body, op, rec)
+}
+
+func (s *Service) checkOwnerMacaroons(ms macaroon.Slice, r *http.Request, body []byte, op string, rec *AuditRecord) (string, error) {
+	auth, err := s.checkMacaroons(ms, requestInfo{request: r, operation: op, audit: rec, body: body})
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	owner := auth.declared["owner"]
+	if owner == "" {
+		s.metrics.authFailure(authFailureNoOwner)
+		return "", errgo.New("no owner declared")
+	}
+	return owner, nil
+}
+
+// createOwner handles the request to create a new owner identity, responding
+// with a macaroon that declares it. Objects created with this macaroon
+// given in the Oostore-Owner header are recorded as owned by it, and may be
+// listed with it later.
+func (s *Service) createOwner(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id, err := newID()
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create an owner ID"))
+		return
+	}
+
+	// The operation caveat keeps the owner macaroon from authorizing
+	// anything but creating and listing objects.
+	m, err := s.bakery.NewMacaroon("", nil, []checkers.Caveat{
+		checkers.DeclaredCaveat("owner", id),
+		{Condition: fmt.Sprintf("%s create,inventory", condOperation)},
+	})
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create macaroon"))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(macaroon.Slice{m})
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// inventory handles the request to list the objects created by an owner.
+func (s *Service) inventory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var ms macaroon.Slice
+	body, err := readJSON(r, &ms)
+	if err != nil {
+		s.metrics.authFailure(authFailureInvalidRequest)
+		httpErrorf(w, http.StatusForbidden, errgo.Notef(err, "invalid request"))
+		return
+	}
+	owner, err := s.checkOwnerMacaroons(ms, r, body, "inventory", nil)
+	if err != nil {
+		authErrorf(w, err)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			httpErrorf(w, http.StatusBadRequest, errgo.Newf("invalid limit %q", v))
+			return
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	objects, err := s.store.List(owner, r.URL.Query().Get("after"), limit)
+	if err != nil {
+		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to list objects"))
+		return
+	}
+	resp := inventoryResponse{Objects: objects}
+	if resp.Objects == nil {
+		resp.Objects = []ObjectInfo{}
+	}
+	if len(objects) == limit {
+		resp.Next = objects[len(objects)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
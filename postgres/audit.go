@@ -0,0 +1,89 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/oostore"
+)
+
+const createAuditTable = `CREATE TABLE IF NOT EXISTS audit (
+	id          BIGSERIAL,
+	time        TIMESTAMP WITH TIME ZONE NOT NULL,
+	operation   TEXT NOT NULL,
+	object      TEXT NOT NULL,
+	macaroon_id TEXT NOT NULL,
+	issued_for  TEXT NOT NULL DEFAULT '',
+	client_addr TEXT NOT NULL,
+	caveats     JSON NOT NULL,
+	allowed     BOOLEAN NOT NULL,
+	reason      TEXT NOT NULL,
+	PRIMARY KEY(id))`
+
+type auditSink struct {
+	db *sql.DB
+}
+
+// NewAuditSink returns a new PostgreSQL audit sink, which records
+// authorization decisions in the audit table.
+func NewAuditSink(db *sql.DB) (*auditSink, error) {
+	s := &auditSink{
+		db: db,
+	}
+	err := s.createIfNotExists()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return s, nil
+}
+
+// Record implements oostore.AuditSink.
+func (s *auditSink) Record(rec *oostore.AuditRecord) error {
+	caveats := rec.Caveats
+	if caveats == nil {
+		caveats = []string{}
+	}
+	caveatsJSON, err := json.Marshal(caveats)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = s.db.Exec(`
+INSERT INTO audit (time, operation, object, macaroon_id, issued_for, client_addr, caveats, allowed, reason)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		rec.Time, rec.Operation, rec.Object, rec.MacaroonID, rec.IssuedFor, rec.ClientAddr, string(caveatsJSON), rec.Allowed, rec.Reason)
+	return errgo.Mask(err, errgo.Any)
+}
+
+func (s *auditSink) createIfNotExists() error {
+	_, err := s.db.Exec(createAuditTable)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err = addColumnIfNotExists(s.db, "audit", column{"issued_for", "TEXT NOT NULL DEFAULT ''"})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err = createIndexIfNotExists(s.db, "audit_object_time", "audit (object, time)")
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return createIndexIfNotExists(s.db, "audit_time", "audit (time)")
+}
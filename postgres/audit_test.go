@@ -0,0 +1,97 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres_test
+
+import (
+	"encoding/json"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+	"github.com/cmars/oostore/postgres"
+)
+
+var _ = gc.Suite(&auditSuite{})
+
+type auditSuite struct {
+	postgresSuite
+	sink oostore.AuditSink
+}
+
+func (s *auditSuite) SetUpTest(c *gc.C) {
+	s.postgresSuite.SetUpTest(c)
+	var err error
+	s.sink, err = postgres.NewAuditSink(s.db)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *auditSuite) TearDownTest(c *gc.C) {
+	s.postgresSuite.TearDownTest(c)
+}
+
+func (s *auditSuite) TestRecord(c *gc.C) {
+	now := time.Now().UTC().Truncate(time.Second)
+	c.Assert(s.sink.Record(&oostore.AuditRecord{
+		Time:       now,
+		Operation:  "fetch",
+		Object:     "foo",
+		MacaroonID: "m1",
+		IssuedFor:  "object foo",
+		ClientAddr: "127.0.0.1",
+		Caveats:    []string{"object foo", "operation fetch"},
+		Allowed:    true,
+	}), gc.IsNil)
+	c.Assert(s.sink.Record(&oostore.AuditRecord{
+		Time:       now.Add(time.Second),
+		Operation:  "delete",
+		Object:     "foo",
+		MacaroonID: "m1",
+		ClientAddr: "127.0.0.1",
+		Caveats:    []string{"object foo", "operation fetch"},
+		Reason:     `operation "delete" not allowed`,
+	}), gc.IsNil)
+	// Sinks created later share the table.
+	_, err := postgres.NewAuditSink(s.db)
+	c.Assert(err, gc.IsNil)
+
+	rows, err := s.db.Query(`
+SELECT time, operation, object, macaroon_id, issued_for, client_addr, caveats, allowed, reason
+FROM audit WHERE object = $1 ORDER BY time`, "foo")
+	c.Assert(err, gc.IsNil)
+	defer rows.Close()
+	var recs []oostore.AuditRecord
+	for rows.Next() {
+		var rec oostore.AuditRecord
+		var caveats string
+		c.Assert(rows.Scan(&rec.Time, &rec.Operation, &rec.Object, &rec.MacaroonID, &rec.IssuedFor, &rec.ClientAddr, &caveats, &rec.Allowed, &rec.Reason), gc.IsNil)
+		c.Assert(json.Unmarshal([]byte(caveats), &rec.Caveats), gc.IsNil)
+		rec.Time = rec.Time.UTC()
+		recs = append(recs, rec)
+	}
+	c.Assert(rows.Err(), gc.IsNil)
+	c.Assert(recs, gc.HasLen, 2)
+	c.Assert(recs[0].Time.Equal(now), gc.Equals, true)
+	c.Assert(recs[0].Operation, gc.Equals, "fetch")
+	c.Assert(recs[0].IssuedFor, gc.Equals, "object foo")
+	c.Assert(recs[0].Allowed, gc.Equals, true)
+	c.Assert(recs[0].Reason, gc.Equals, "")
+	c.Assert(recs[0].Caveats, gc.DeepEquals, []string{"object foo", "operation fetch"})
+	c.Assert(recs[1].Operation, gc.Equals, "delete")
+	c.Assert(recs[1].Allowed, gc.Equals, false)
+	c.Assert(recs[1].Reason, gc.Equals, `operation "delete" not allowed`)
+}
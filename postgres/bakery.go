@@ -48,15 +48,7 @@ func NewBakeryStorage(db *sql.DB) (*bakeryStorage, error) {
 
 // Get implements bakery.Storage.
 func (s *bakeryStorage) Get(location string) (string, error) {
-	var item string
-	row := s.db.QueryRow(`SELECT item FROM bakery WHERE location = $1`, location)
-	err := row.Scan(&item)
-	if err == sql.ErrNoRows {
-		return "", bakery.ErrNotFound
-	} else if err != nil {
-		return "", errgo.Mask(err, errgo.Any)
-	}
-	return item, nil
+	return getBakeryItem(s.db, location)
 }
 
 // Put implements bakery.Storage.
@@ -69,8 +61,7 @@ func (s *bakeryStorage) Put(location, item string) (_err error) {
 		_err = completeTransaction(tx, _err)
 	}()
 
-	_, err = tx.Exec(`INSERT INTO bakery (location, item) VALUES ($1, $2)`, location, item)
-	return errgo.Mask(err, errgo.Any)
+	return putBakeryItem(tx, location, item)
 }
 
 // Del implements bakery.Storage.
@@ -83,7 +74,55 @@ func (s *bakeryStorage) Del(location string) (_err error) {
 		_err = completeTransaction(tx, _err)
 	}()
 
-	result, err := tx.Exec(`DELETE FROM bakery WHERE location = $1`, location)
+	return delBakeryItem(tx, location)
+}
+
+// txBakeryStorage is bakery storage within a transaction, so that root keys
+// can be stored together with other changes.
+type txBakeryStorage struct {
+	tx *sql.Tx
+}
+
+// Get implements bakery.Storage.
+func (s *txBakeryStorage) Get(location string) (string, error) {
+	return getBakeryItem(s.tx, location)
+}
+
+// Put implements bakery.Storage.
+func (s *txBakeryStorage) Put(location, item string) error {
+	return putBakeryItem(s.tx, location, item)
+}
+
+// Del implements bakery.Storage.
+func (s *txBakeryStorage) Del(location string) error {
+	return delBakeryItem(s.tx, location)
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getBakeryItem(q queryer, location string) (string, error) {
+	var item string
+	row := q.QueryRow(`SELECT item FROM bakery WHERE location = $1`, location)
+	err := row.Scan(&item)
+	if err == sql.ErrNoRows {
+		return "", bakery.ErrNotFound
+	} else if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	return item, nil
+}
+
+func putBakeryItem(q queryer, location, item string) error {
+	_, err := q.Exec(`INSERT INTO bakery (location, item) VALUES ($1, $2)`, location, item)
+	return errgo.Mask(err, errgo.Any)
+}
+
+func delBakeryItem(q queryer, location string) error {
+	result, err := q.Exec(`DELETE FROM bakery WHERE location = $1`, location)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -103,5 +142,11 @@ func (s *bakeryStorage) Del(location string) (_err error) {
 
 func (s *bakeryStorage) createIfNotExists() error {
 	_, err := s.db.Exec(createBakeryTable)
-	return errgo.Mask(err, errgo.Any)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	// Existing items are given the time the column was added, which is
+	// later than they were created, but no later than is safe for garbage
+	// collection.
+	return addColumnIfNotExists(s.db, "bakery", column{"created", "TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()"})
 }
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/oostore"
+)
+
+const createCollectionTable = `CREATE TABLE IF NOT EXISTS collection (
+	id TEXT,
+	PRIMARY KEY(id))`
+
+const createCollectionMemberTable = `CREATE TABLE IF NOT EXISTS collection_member (
+	collection TEXT REFERENCES collection(id) ON DELETE CASCADE,
+	object     TEXT,
+	PRIMARY KEY(collection, object))`
+
+type collectionStorage struct {
+	db *sql.DB
+}
+
+// NewCollectionStorage returns a new PostgreSQL collection storage instance.
+func NewCollectionStorage(db *sql.DB) (*collectionStorage, error) {
+	st := &collectionStorage{
+		db: db,
+	}
+	err := st.createIfNotExists()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return st, nil
+}
+
+// Create implements oostore.CollectionStorage.
+func (s *collectionStorage) Create(id string) (_err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	_, err = tx.Exec(`INSERT INTO collection (id) VALUES ($1)`, id)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Add implements oostore.CollectionStorage.
+func (s *collectionStorage) Add(id string, objectID string) (_err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	err = collectionExists(tx, id)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(oostore.ErrNotFound))
+	}
+	_, err = tx.Exec(`
+INSERT INTO collection_member (collection, object) SELECT $1, $2
+WHERE NOT EXISTS (SELECT 1 FROM collection_member WHERE collection = $1 AND object = $2)`,
+		id, objectID)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Members implements oostore.CollectionStorage.
+func (s *collectionStorage) Members(id string) (_ []string, _err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	err = collectionExists(tx, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(oostore.ErrNotFound))
+	}
+	rows, err := tx.Query(`SELECT object FROM collection_member WHERE collection = $1 ORDER BY object`, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var objectID string
+		err = rows.Scan(&objectID)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		members = append(members, objectID)
+	}
+	return members, errgo.Mask(rows.Err(), errgo.Any)
+}
+
+// HasMember implements oostore.CollectionStorage.
+func (s *collectionStorage) HasMember(id string, objectID string) (bool, error) {
+	var count int
+	row := s.db.QueryRow(`SELECT COUNT(1) FROM collection_member WHERE collection = $1 AND object = $2`,
+		id, objectID)
+	err := row.Scan(&count)
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	return count > 0, nil
+}
+
+// RemoveObject implements oostore.CollectionStorage.
+func (s *collectionStorage) RemoveObject(objectID string) error {
+	_, err := s.db.Exec(`DELETE FROM collection_member WHERE object = $1`, objectID)
+	return errgo.Mask(err, errgo.Any)
+}
+
+func (s *collectionStorage) createIfNotExists() error {
+	return createCollectionTables(s.db)
+}
+
+func createCollectionTables(db *sql.DB) error {
+	_, err := db.Exec(createCollectionTable)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	_, err = db.Exec(createCollectionMemberTable)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return createIndexIfNotExists(db, "collection_member_object", "collection_member (object)")
+}
+
+func collectionExists(tx *sql.Tx, id string) error {
+	var count int
+	row := tx.QueryRow(`SELECT COUNT(1) FROM collection WHERE id = $1`, id)
+	err := row.Scan(&count)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if count == 0 {
+		return oostore.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+	"github.com/cmars/oostore/postgres"
+)
+
+var _ = gc.Suite(&collectionSuite{})
+
+type collectionSuite struct {
+	postgresSuite
+	storage oostore.CollectionStorage
+}
+
+func (s *collectionSuite) SetUpTest(c *gc.C) {
+	s.postgresSuite.SetUpTest(c)
+	var err error
+	s.storage, err = postgres.NewCollectionStorage(s.db)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *collectionSuite) TearDownTest(c *gc.C) {
+	s.postgresSuite.TearDownTest(c)
+}
+
+func (s *collectionSuite) TestMembers(c *gc.C) {
+	c.Assert(s.storage.Create("foo"), gc.IsNil)
+	c.Assert(s.storage.Create("foo"), gc.NotNil)
+	c.Assert(s.storage.Create("bar"), gc.IsNil)
+	// New collections are empty.
+	members, err := s.storage.Members("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(members, gc.HasLen, 0)
+	// Add some members, with a duplicate.
+	c.Assert(s.storage.Add("foo", "b"), gc.IsNil)
+	c.Assert(s.storage.Add("foo", "a"), gc.IsNil)
+	c.Assert(s.storage.Add("foo", "a"), gc.IsNil)
+	c.Assert(s.storage.Add("bar", "c"), gc.IsNil)
+	members, err = s.storage.Members("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(members, gc.DeepEquals, []string{"a", "b"})
+	for i, testCase := range []struct {
+		id, objectID string
+		ok           bool
+	}{{"foo", "a", true}, {"foo", "b", true}, {"foo", "c", false}, {"bar", "c", true}, {"nope", "a", false}} {
+		comment := gc.Commentf("test#%d expect membership %#v", i, testCase)
+		ok, err := s.storage.HasMember(testCase.id, testCase.objectID)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(ok, gc.Equals, testCase.ok, comment)
+	}
+	// Collections that don't exist should give "not found" error.
+	_, err = s.storage.Members("nope")
+	c.Assert(err, gc.Equals, oostore.ErrNotFound)
+	c.Assert(s.storage.Add("nope", "a"), gc.Equals, oostore.ErrNotFound)
+}
+
+func (s *collectionSuite) TestRemoveObject(c *gc.C) {
+	c.Assert(s.storage.Create("foo"), gc.IsNil)
+	c.Assert(s.storage.Create("bar"), gc.IsNil)
+	c.Assert(s.storage.Add("foo", "a"), gc.IsNil)
+	c.Assert(s.storage.Add("foo", "b"), gc.IsNil)
+	c.Assert(s.storage.Add("bar", "a"), gc.IsNil)
+	c.Assert(s.storage.RemoveObject("a"), gc.IsNil)
+	c.Assert(s.storage.RemoveObject("nope"), gc.IsNil)
+	members, err := s.storage.Members("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(members, gc.DeepEquals, []string{"b"})
+	members, err = s.storage.Members("bar")
+	c.Assert(err, gc.IsNil)
+	c.Assert(members, gc.HasLen, 0)
+}
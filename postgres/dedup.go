@@ -0,0 +1,278 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/cmars/oostore"
+)
+
+const createBlobTable = `CREATE TABLE IF NOT EXISTS blob (
+	hash     TEXT,
+	contents bytea,
+	refs     INTEGER NOT NULL,
+	PRIMARY KEY(hash))`
+
+const createBlobObjectTable = `CREATE TABLE IF NOT EXISTS blob_object (
+	id          TEXT,
+	hash        TEXT NOT NULL REFERENCES blob(hash),
+	contentType TEXT,
+	owner       TEXT,
+	created     TIMESTAMP WITH TIME ZONE,
+	PRIMARY KEY(id))`
+
+// blobObjectColumns have been added to the blob_object table since it was
+// first created, so they may need to be added to existing tables.
+var blobObjectColumns = []column{
+	{"encoding", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const blobUsageTable = "blob_usage"
+
+// The total stored counts each blob once, while each owner is counted the
+// size of every object they have created.
+const populateBlobUsage = `
+SELECT '', COALESCE(SUM(octet_length(contents)), 0) FROM blob
+UNION ALL
+SELECT blob_object.owner, SUM(octet_length(blob.contents))
+FROM blob_object JOIN blob ON blob.hash = blob_object.hash
+WHERE blob_object.owner IS NOT NULL GROUP BY blob_object.owner`
+
+type dedupStorage struct {
+	db *sql.DB
+}
+
+// NewDedupStorage returns a new PostgreSQL object storage instance which
+// stores identical contents only once, keyed by content hash. Contents are
+// reference counted, and removed when the last object referring to them is
+// deleted.
+func NewDedupStorage(db *sql.DB) (*dedupStorage, error) {
+	st := &dedupStorage{
+		db: db,
+	}
+	err := st.createIfNotExists()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return st, nil
+}
+
+// Get implements oostore.Storage.
+func (s *dedupStorage) Get(id string) ([]byte, string, error) {
+	contents, contentType, encoding, err := s.GetEncoded(id)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = oostore.DecodeContents(contents, encoding)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot decode %q", id)
+	}
+	return contents, contentType, nil
+}
+
+// GetEncoded implements oostore.EncodedGetter.
+func (s *dedupStorage) GetEncoded(id string) ([]byte, string, string, error) {
+	var (
+		contents              []byte
+		contentType, encoding string
+	)
+	row := s.db.QueryRow(`
+SELECT blob.contents, blob_object.contentType, blob_object.encoding FROM blob_object
+JOIN blob ON blob.hash = blob_object.hash WHERE blob_object.id = $1`, id)
+	err := row.Scan(&contents, &contentType, &encoding)
+	if err == sql.ErrNoRows {
+		return nil, "", "", oostore.ErrNotFound
+	} else if err != nil {
+		return nil, "", "", errgo.Mask(err, errgo.Any)
+	}
+	return contents, contentType, encoding, nil
+}
+
+// Put implements oostore.Storage.
+func (s *dedupStorage) Put(id string, contents []byte, contentType string) error {
+	return s.PutOwned(id, contents, contentType, "")
+}
+
+// PutOwned implements oostore.Storage.
+func (s *dedupStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	return s.PutEncoded(id, contents, contentType, "", owner)
+}
+
+// PutEncoded implements oostore.EncodedStorage.
+func (s *dedupStorage) PutEncoded(id string, contents []byte, contentType string, encoding string, owner string) (_err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	return errgo.Mask(s.putOwned(tx, id, contents, contentType, encoding, owner), errgo.Any)
+}
+
+// CreateObject implements oostore.AtomicCreator.
+func (s *dedupStorage) CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error {
+	return s.CreateEncodedObject(id, contents, contentType, "", owner, newMacaroon)
+}
+
+// CreateEncodedObject implements oostore.EncodedCreator.
+func (s *dedupStorage) CreateEncodedObject(id string, contents []byte, contentType string, encoding string, owner string, newMacaroon func(bakery.Storage) error) (_err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	err = s.putOwned(tx, id, contents, contentType, encoding, owner)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(newMacaroon(&txBakeryStorage{tx}), errgo.Any)
+}
+
+func (s *dedupStorage) putOwned(tx *sql.Tx, id string, contents []byte, contentType string, encoding string, owner string) error {
+	hash := oostore.ContentHash(contents)
+	// The same contents may be stored concurrently, in which case the
+	// insert waits for the other to commit and then adds a reference
+	// instead.
+	var refs int
+	row := tx.QueryRow(`
+INSERT INTO blob (hash, contents, refs) VALUES ($1, $2, 1)
+ON CONFLICT (hash) DO UPDATE SET refs = blob.refs + 1 RETURNING refs`, hash, contents)
+	err := row.Scan(&refs)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if refs == 1 {
+		err = addUsage(tx, blobUsageTable, "", int64(len(contents)))
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+
+	_, err = tx.Exec(`
+INSERT INTO blob_object (id, hash, contentType, encoding, owner, created) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)`,
+		id, hash, contentType, encoding, owner, time.Now().UTC())
+	if err != nil || owner == "" {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(addUsage(tx, blobUsageTable, owner, int64(len(contents))), errgo.Any)
+}
+
+// Delete implements oostore.Storage.
+func (s *dedupStorage) Delete(id string) (_err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	var hash, owner string
+	row := tx.QueryRow(`DELETE FROM blob_object WHERE id = $1 RETURNING hash, COALESCE(owner, '')`, id)
+	err = row.Scan(&hash, &owner)
+	if err == sql.ErrNoRows {
+		return oostore.ErrNotFound
+	} else if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var size int64
+	row = tx.QueryRow(`UPDATE blob SET refs = refs - 1 WHERE hash = $1 RETURNING octet_length(contents)`, hash)
+	err = row.Scan(&size)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	result, err := tx.Exec(`DELETE FROM blob WHERE hash = $1 AND refs <= 0`, hash)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if n > 0 {
+		err = addUsage(tx, blobUsageTable, "", -size)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	if owner == "" {
+		return nil
+	}
+	return errgo.Mask(addUsage(tx, blobUsageTable, owner, -size), errgo.Any)
+}
+
+// Usage implements oostore.Storage.
+func (s *dedupStorage) Usage(owner string) (int64, error) {
+	size, err := getUsage(s.db, blobUsageTable, owner)
+	return size, errgo.Mask(err, errgo.Any)
+}
+
+// List implements oostore.Storage.
+func (s *dedupStorage) List(owner string, after string, limit int) ([]oostore.ObjectInfo, error) {
+	rows, err := s.db.Query(`
+SELECT blob_object.id, blob_object.contentType, octet_length(blob.contents), blob_object.created
+FROM blob_object JOIN blob ON blob.hash = blob_object.hash
+WHERE blob_object.owner = $1 AND blob_object.id > $2 ORDER BY blob_object.id LIMIT $3`,
+		owner, after, limit)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer rows.Close()
+	var result []oostore.ObjectInfo
+	for rows.Next() {
+		var info oostore.ObjectInfo
+		err = rows.Scan(&info.ID, &info.ContentType, &info.Size, &info.Created)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		info.Created = info.Created.UTC()
+		result = append(result, info)
+	}
+	return result, errgo.Mask(rows.Err(), errgo.Any)
+}
+
+func (s *dedupStorage) createIfNotExists() error {
+	_, err := s.db.Exec(createBlobTable)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	_, err = s.db.Exec(createBlobObjectTable)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, col := range blobObjectColumns {
+		err = addColumnIfNotExists(s.db, "blob_object", col)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	err = createIndexIfNotExists(s.db, "blob_object_owner_id", "blob_object (owner, id)")
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return createUsageTableIfNotExists(s.db, blobUsageTable, populateBlobUsage)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+	"github.com/cmars/oostore/postgres"
+)
+
+var _ = gc.Suite(&dedupSuite{})
+
+type dedupSuite struct {
+	postgresSuite
+	storage oostore.Storage
+}
+
+func (s *dedupSuite) SetUpTest(c *gc.C) {
+	s.postgresSuite.SetUpTest(c)
+	var err error
+	s.storage, err = postgres.NewDedupStorage(s.db)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *dedupSuite) TearDownTest(c *gc.C) {
+	s.postgresSuite.TearDownTest(c)
+}
+
+func (s *dedupSuite) TestCRUD(c *gc.C) {
+	// Put some records in, some with the same contents.
+	c.Assert(s.storage.Put("baz", []byte("quux"), "quux-ish"), gc.IsNil)
+	c.Assert(s.storage.Put("foo", []byte("bar"), "bar-ish"), gc.IsNil)
+	c.Assert(s.storage.Put("foo2", []byte("bar"), "other-bar-ish"), gc.IsNil)
+	// Duplicate IDs are refused, without adding a reference.
+	c.Assert(s.storage.Put("foo", []byte("bar"), "bar-ish"), gc.NotNil)
+	c.Assert(s.blobCount(c), gc.Equals, 2)
+	c.Assert(s.refs(c, "bar"), gc.Equals, 2)
+	// Should be able to get them back out, with their own content types.
+	for i, testCase := range []struct {
+		id, contents, contentType string
+	}{{"foo", "bar", "bar-ish"}, {"foo2", "bar", "other-bar-ish"}, {"baz", "quux", "quux-ish"}} {
+		comment := gc.Commentf("test#%d expect contents %#v", i, testCase)
+		content, contentType, err := s.storage.Get(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(content, gc.DeepEquals, []byte(testCase.contents), comment)
+		c.Assert(contentType, gc.Equals, testCase.contentType, comment)
+	}
+	// Deleting one reference leaves the contents for the other.
+	c.Assert(s.storage.Delete("foo"), gc.IsNil)
+	c.Assert(s.refs(c, "bar"), gc.Equals, 1)
+	content, _, err := s.storage.Get("foo2")
+	c.Assert(err, gc.IsNil)
+	c.Assert(content, gc.DeepEquals, []byte("bar"))
+	// Deleting the last reference removes the contents.
+	c.Assert(s.storage.Delete("foo2"), gc.IsNil)
+	c.Assert(s.blobCount(c), gc.Equals, 1)
+	// Get records that don't exist, should give "not found" error.
+	for _, id := range []string{"foo", "foo2", "never-seen-it"} {
+		comment := gc.Commentf("id %q", id)
+		_, _, err = s.storage.Get(id)
+		c.Check(err, gc.Equals, oostore.ErrNotFound, comment)
+		c.Check(s.storage.Delete(id), gc.Equals, oostore.ErrNotFound, comment)
+	}
+	c.Assert(s.refs(c, "quux"), gc.Equals, 1)
+}
+
+func (s *dedupSuite) blobCount(c *gc.C) int {
+	var count int
+	row := s.db.QueryRow("SELECT COUNT(1) FROM blob")
+	c.Assert(row.Scan(&count), gc.IsNil)
+	return count
+}
+
+func (s *dedupSuite) refs(c *gc.C, contents string) int {
+	var refs int
+	row := s.db.QueryRow("SELECT refs FROM blob WHERE hash = $1", oostore.ContentHash([]byte(contents)))
+	c.Assert(row.Scan(&refs), gc.IsNil)
+	return refs
+}
+
+func (s *dedupSuite) TestCreateObject(c *gc.C) {
+	testCreateObject(c, s.db, s.storage)
+	c.Assert(s.refs(c, "bar"), gc.Equals, 1)
+}
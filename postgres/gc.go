@@ -0,0 +1,112 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// Collector removes unreachable entries from the bakery tables: root keys of
+// object macaroons whose objects have been deleted, or were never stored,
+// and rotated root keys which have expired. It also removes collection
+// memberships of objects which no longer exist, such as those deleted
+// before memberships were removed along with them.
+//
+// Root keys of macaroons issued before object macaroon IDs were derived from
+// object IDs can't be matched to their objects, and are left alone. Root keys
+// of collection and owner macaroons are never unreachable, as collections and
+// owners are never deleted, so they are left alone too.
+type Collector struct {
+	db          *sql.DB
+	objectTable string
+	grace       time.Duration
+}
+
+// NewCollector returns a new Collector for the given object storage, which
+// must have been returned by NewObjectStorage or NewDedupStorage. Root keys
+// are only removed once they are older than grace, so that objects being
+// created while the collector runs are not affected.
+func NewCollector(db *sql.DB, objects oostore.Storage, grace time.Duration) (*Collector, error) {
+	var objectTable string
+	switch objects.(type) {
+	case *objectStorage:
+		objectTable = "object"
+	case *dedupStorage:
+		objectTable = "blob_object"
+	default:
+		return nil, errgo.Newf("cannot collect garbage for %T", objects)
+	}
+	_, err := NewBakeryStorage(db)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	_, err = db.Exec(createRootKeyTable)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	err = createCollectionTables(db)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &Collector{
+		db:          db,
+		objectTable: objectTable,
+		grace:       grace,
+	}, nil
+}
+
+// Collect removes unreachable root keys and collection memberships,
+// returning how many were removed.
+func (c *Collector) Collect() (int64, error) {
+	now := time.Now().UTC()
+	result, err := c.db.Exec(fmt.Sprintf(`
+DELETE FROM bakery WHERE location LIKE $1 || '%%' AND created < $2
+AND NOT EXISTS (SELECT 1 FROM %s WHERE id = substr(bakery.location, $3))`, c.objectTable),
+		oostore.ObjectMacaroonIDPrefix, now.Add(-c.grace), len(oostore.ObjectMacaroonIDPrefix)+1)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	orphans, err := result.RowsAffected()
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	result, err = c.db.Exec(`DELETE FROM root_key WHERE expires <= $1`, now)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	expired, err := result.RowsAffected()
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	result, err = c.db.Exec(fmt.Sprintf(`
+DELETE FROM collection_member
+WHERE NOT EXISTS (SELECT 1 FROM %s WHERE id = collection_member.object)`, c.objectTable))
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	members, err := result.RowsAffected()
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	return orphans + expired + members, nil
+}
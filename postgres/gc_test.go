@@ -0,0 +1,147 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/cmars/oostore"
+	"github.com/cmars/oostore/postgres"
+)
+
+var _ = gc.Suite(&collectorSuite{})
+
+type collectorSuite struct {
+	postgresSuite
+}
+
+func (s *collectorSuite) TestCollect(c *gc.C) {
+	for _, newStorage := range []func() (oostore.Storage, error){
+		func() (oostore.Storage, error) { return postgres.NewObjectStorage(s.db) },
+		func() (oostore.Storage, error) { return postgres.NewDedupStorage(s.db) },
+	} {
+		objects, err := newStorage()
+		c.Assert(err, gc.IsNil)
+		bakeryStore, err := postgres.NewBakeryStorage(s.db)
+		c.Assert(err, gc.IsNil)
+
+		c.Assert(objects.Put("live", []byte("live"), "text/plain"), gc.IsNil)
+		c.Assert(objects.Put("deleted", []byte("deleted"), "text/plain"), gc.IsNil)
+		c.Assert(objects.Delete("deleted"), gc.IsNil)
+		for _, id := range []string{
+			oostore.ObjectMacaroonID("live"),
+			oostore.ObjectMacaroonID("deleted"),
+			oostore.ObjectMacaroonID("never-stored"),
+			"legacy",
+		} {
+			c.Assert(bakeryStore.Put(id, `{"RootKey":"aGVsbG8="}`), gc.IsNil)
+		}
+
+		// Nothing is collected within the grace period.
+		collector, err := postgres.NewCollector(s.db, objects, time.Hour)
+		c.Assert(err, gc.IsNil)
+		n, err := collector.Collect()
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, int64(0))
+
+		_, err = s.db.Exec(`UPDATE bakery SET created = created - interval '2 hours'`)
+		c.Assert(err, gc.IsNil)
+		n, err = collector.Collect()
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, int64(2))
+		for id, found := range map[string]bool{
+			oostore.ObjectMacaroonID("live"):         true,
+			oostore.ObjectMacaroonID("deleted"):      false,
+			oostore.ObjectMacaroonID("never-stored"): false,
+			"legacy":                                 true,
+		} {
+			_, err := bakeryStore.Get(id)
+			if found {
+				c.Check(err, gc.IsNil, gc.Commentf("id %q", id))
+			} else {
+				c.Check(err, gc.Equals, bakery.ErrNotFound, gc.Commentf("id %q", id))
+			}
+		}
+
+		_, err = s.db.Exec(`DELETE FROM bakery`)
+		c.Assert(err, gc.IsNil)
+		c.Assert(objects.Delete("live"), gc.IsNil)
+	}
+}
+
+func (s *collectorSuite) TestCollectCollectionMembers(c *gc.C) {
+	for _, newStorage := range []func() (oostore.Storage, error){
+		func() (oostore.Storage, error) { return postgres.NewObjectStorage(s.db) },
+		func() (oostore.Storage, error) { return postgres.NewDedupStorage(s.db) },
+	} {
+		objects, err := newStorage()
+		c.Assert(err, gc.IsNil)
+		collections, err := postgres.NewCollectionStorage(s.db)
+		c.Assert(err, gc.IsNil)
+
+		c.Assert(objects.Put("live", []byte("live"), "text/plain"), gc.IsNil)
+		c.Assert(objects.Put("deleted", []byte("deleted"), "text/plain"), gc.IsNil)
+		c.Assert(objects.Delete("deleted"), gc.IsNil)
+		c.Assert(collections.Create("coll"), gc.IsNil)
+		c.Assert(collections.Add("coll", "live"), gc.IsNil)
+		c.Assert(collections.Add("coll", "deleted"), gc.IsNil)
+
+		// Memberships are not subject to the grace period, as objects
+		// must be stored before they can be added to a collection.
+		collector, err := postgres.NewCollector(s.db, objects, time.Hour)
+		c.Assert(err, gc.IsNil)
+		n, err := collector.Collect()
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, int64(1))
+		members, err := collections.Members("coll")
+		c.Assert(err, gc.IsNil)
+		c.Assert(members, gc.DeepEquals, []string{"live"})
+
+		_, err = s.db.Exec(`DELETE FROM collection`)
+		c.Assert(err, gc.IsNil)
+		c.Assert(objects.Delete("live"), gc.IsNil)
+	}
+}
+
+func (s *collectorSuite) TestCollectExpiredRootKeys(c *gc.C) {
+	objects, err := postgres.NewObjectStorage(s.db)
+	c.Assert(err, gc.IsNil)
+	rootKeys, err := postgres.NewRootKeyStorage(s.db, oostore.RootKeyPolicy{
+		GenerateInterval: time.Hour,
+		ExpiryDuration:   time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	_, id, err := rootKeys.RootKey()
+	c.Assert(err, gc.IsNil)
+
+	collector, err := postgres.NewCollector(s.db, objects, time.Hour)
+	c.Assert(err, gc.IsNil)
+	n, err := collector.Collect()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, int64(0))
+
+	_, err = s.db.Exec(`UPDATE root_key SET expires = expires - interval '3 hours'`)
+	c.Assert(err, gc.IsNil)
+	n, err = collector.Collect()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, int64(1))
+	_, err = rootKeys.Get(id)
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
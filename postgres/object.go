@@ -19,9 +19,11 @@ package postgres
 import (
 	"database/sql"
 	"log"
+	"time"
 
 	_ "github.com/lib/pq"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
 
 	"github.com/cmars/oostore"
 )
@@ -32,6 +34,21 @@ const createObjectTable = `CREATE TABLE IF NOT EXISTS object (
 	contents    bytea,
 	PRIMARY KEY(id))`
 
+// objectColumns have been added to the object table since it was first
+// created, so they may need to be added to existing tables.
+var objectColumns = []column{
+	{"owner", "TEXT"},
+	{"created", "TIMESTAMP WITH TIME ZONE"},
+	{"encoding", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const objectUsageTable = "object_usage"
+
+const populateObjectUsage = `
+SELECT '', COALESCE(SUM(octet_length(contents)), 0) FROM object
+UNION ALL
+SELECT owner, SUM(octet_length(contents)) FROM object WHERE owner IS NOT NULL GROUP BY owner`
+
 type objectStorage struct {
 	db *sql.DB
 }
@@ -50,22 +67,45 @@ func NewObjectStorage(db *sql.DB) (*objectStorage, error) {
 
 // Get implements oostore.Storage.
 func (s *objectStorage) Get(id string) ([]byte, string, error) {
+	contents, contentType, encoding, err := s.GetEncoded(id)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = oostore.DecodeContents(contents, encoding)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot decode %q", id)
+	}
+	return contents, contentType, nil
+}
+
+// GetEncoded implements oostore.EncodedGetter.
+func (s *objectStorage) GetEncoded(id string) ([]byte, string, string, error) {
 	var (
-		contents    []byte
-		contentType string
+		contents              []byte
+		contentType, encoding string
 	)
-	row := s.db.QueryRow(`SELECT contents, contentType FROM object WHERE id = $1`, id)
-	err := row.Scan(&contents, &contentType)
+	row := s.db.QueryRow(`SELECT contents, contentType, encoding FROM object WHERE id = $1`, id)
+	err := row.Scan(&contents, &contentType, &encoding)
 	if err == sql.ErrNoRows {
-		return nil, "", oostore.ErrNotFound
+		return nil, "", "", oostore.ErrNotFound
 	} else if err != nil {
-		return nil, "", errgo.Mask(err, errgo.Any)
+		return nil, "", "", errgo.Mask(err, errgo.Any)
 	}
-	return contents, contentType, nil
+	return contents, contentType, encoding, nil
 }
 
 // Put implements oostore.Storage.
-func (s *objectStorage) Put(id string, contents []byte, contentType string) (_err error) {
+func (s *objectStorage) Put(id string, contents []byte, contentType string) error {
+	return s.PutOwned(id, contents, contentType, "")
+}
+
+// PutOwned implements oostore.Storage.
+func (s *objectStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	return s.PutEncoded(id, contents, contentType, "", owner)
+}
+
+// PutEncoded implements oostore.EncodedStorage.
+func (s *objectStorage) PutEncoded(id string, contents []byte, contentType string, encoding string, owner string) (_err error) {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
@@ -74,9 +114,39 @@ func (s *objectStorage) Put(id string, contents []byte, contentType string) (_er
 		_err = completeTransaction(tx, _err)
 	}()
 
-	_, err = tx.Exec(`INSERT INTO object (id, contents, contentType) VALUES ($1, $2, $3)`,
-		id, contents, contentType)
-	return errgo.Mask(err, errgo.Any)
+	return errgo.Mask(s.putOwned(tx, id, contents, contentType, encoding, owner), errgo.Any)
+}
+
+// CreateObject implements oostore.AtomicCreator.
+func (s *objectStorage) CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error {
+	return s.CreateEncodedObject(id, contents, contentType, "", owner, newMacaroon)
+}
+
+// CreateEncodedObject implements oostore.EncodedCreator.
+func (s *objectStorage) CreateEncodedObject(id string, contents []byte, contentType string, encoding string, owner string, newMacaroon func(bakery.Storage) error) (_err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	err = s.putOwned(tx, id, contents, contentType, encoding, owner)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(newMacaroon(&txBakeryStorage{tx}), errgo.Any)
+}
+
+func (s *objectStorage) putOwned(tx *sql.Tx, id string, contents []byte, contentType string, encoding string, owner string) error {
+	_, err := tx.Exec(`
+INSERT INTO object (id, contents, contentType, encoding, owner, created) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)`,
+		id, contents, contentType, encoding, owner, time.Now().UTC())
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(addTotalUsage(tx, objectUsageTable, owner, int64(len(contents))), errgo.Any)
 }
 
 // Delete implements oostore.Storage.
@@ -89,27 +159,123 @@ func (s *objectStorage) Delete(id string) (_err error) {
 		_err = completeTransaction(tx, _err)
 	}()
 
-	result, err := tx.Exec(`DELETE FROM object WHERE id = $1`, id)
+	var owner string
+	var size int64
+	row := tx.QueryRow(`DELETE FROM object WHERE id = $1 RETURNING COALESCE(owner, ''), octet_length(contents)`, id)
+	err = row.Scan(&owner, &size)
+	if err == sql.ErrNoRows {
+		return oostore.ErrNotFound
+	} else if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(addTotalUsage(tx, objectUsageTable, owner, -size), errgo.Any)
+}
+
+// Usage implements oostore.Storage.
+func (s *objectStorage) Usage(owner string) (int64, error) {
+	size, err := getUsage(s.db, objectUsageTable, owner)
+	return size, errgo.Mask(err, errgo.Any)
+}
+
+// List implements oostore.Storage.
+func (s *objectStorage) List(owner string, after string, limit int) ([]oostore.ObjectInfo, error) {
+	rows, err := s.db.Query(`
+SELECT id, contentType, octet_length(contents), created FROM object
+WHERE owner = $1 AND id > $2 ORDER BY id LIMIT $3`, owner, after, limit)
 	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer rows.Close()
+	var result []oostore.ObjectInfo
+	for rows.Next() {
+		var info oostore.ObjectInfo
+		err = rows.Scan(&info.ID, &info.ContentType, &info.Size, &info.Created)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		info.Created = info.Created.UTC()
+		result = append(result, info)
+	}
+	return result, errgo.Mask(rows.Err(), errgo.Any)
+}
+
+// Rewrite implements oostore.ContentRewriter. Each object is rewritten in
+// its own transaction, so that the whole table is not locked at once.
+func (s *objectStorage) Rewrite(f func(id string, contents []byte) ([]byte, error)) error {
+	rows, err := s.db.Query(`SELECT id FROM object ORDER BY id`)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return errgo.Mask(err, errgo.Any)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-	n, err := result.RowsAffected()
+	for _, id := range ids {
+		err = s.rewrite(id, f)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+func (s *objectStorage) rewrite(id string, f func(id string, contents []byte) ([]byte, error)) (_err error) {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-	switch n {
-	case 0:
-		return oostore.ErrNotFound
-	case 1:
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	var contents []byte
+	var owner string
+	row := tx.QueryRow(`SELECT contents, COALESCE(owner, '') FROM object WHERE id = $1 FOR UPDATE`, id)
+	err = row.Scan(&contents, &owner)
+	if err == sql.ErrNoRows {
+		// Deleted since it was listed.
 		return nil
-	default:
-		return errgo.Newf("deleted %d rows, expected 1", n)
+	} else if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	oldSize := len(contents)
+	contents, err = f(id, contents)
+	if err != nil || contents == nil {
+		return errgo.Mask(err, errgo.Any)
 	}
+	_, err = tx.Exec(`UPDATE object SET contents = $2 WHERE id = $1`, id, contents)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(addTotalUsage(tx, objectUsageTable, owner, int64(len(contents)-oldSize)), errgo.Any)
 }
 
 func (s *objectStorage) createIfNotExists() error {
 	_, err := s.db.Exec(createObjectTable)
-	return errgo.Mask(err, errgo.Any)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, col := range objectColumns {
+		err = addColumnIfNotExists(s.db, "object", col)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	err = createIndexIfNotExists(s.db, "object_owner_id", "object (owner, id)")
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return createUsageTableIfNotExists(s.db, objectUsageTable, populateObjectUsage)
 }
 
 func completeTransaction(tx *sql.Tx, errResult error) error {
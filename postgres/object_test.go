@@ -17,7 +17,11 @@
 package postgres_test
 
 import (
+	"database/sql"
+
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
 
 	"github.com/cmars/oostore"
 	"github.com/cmars/oostore/postgres"
@@ -94,3 +98,125 @@ func (s *objectSuite) TestPrimaryKey(c *gc.C) {
 		c.Assert(count, gc.Equals, 1, comment)
 	}
 }
+
+func (s *objectSuite) TestList(c *gc.C) {
+	c.Assert(s.storage.PutOwned("b", []byte("bb"), "b-ish", "alice"), gc.IsNil)
+	c.Assert(s.storage.PutOwned("a", []byte("a"), "a-ish", "alice"), gc.IsNil)
+	c.Assert(s.storage.PutOwned("c", []byte("ccc"), "c-ish", "alice"), gc.IsNil)
+	c.Assert(s.storage.PutOwned("d", []byte("dddd"), "d-ish", "bob"), gc.IsNil)
+	c.Assert(s.storage.Put("e", []byte("eeeee"), "e-ish"), gc.IsNil)
+	sizes := map[string]int64{"a": 1, "b": 2, "c": 3, "d": 4}
+	for i, testCase := range []struct {
+		owner, after string
+		limit        int
+		ids          []string
+	}{
+		{"alice", "", 10, []string{"a", "b", "c"}},
+		{"alice", "", 2, []string{"a", "b"}},
+		{"alice", "b", 2, []string{"c"}},
+		{"alice", "c", 2, nil},
+		{"bob", "", 10, []string{"d"}},
+		{"", "", 10, nil},
+		{"nobody", "", 10, nil},
+	} {
+		comment := gc.Commentf("test#%d expect list %#v", i, testCase)
+		infos, err := s.storage.List(testCase.owner, testCase.after, testCase.limit)
+		c.Assert(err, gc.IsNil, comment)
+		var ids []string
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+			c.Assert(info.ContentType, gc.Equals, info.ID+"-ish", comment)
+			c.Assert(info.Size, gc.Equals, sizes[info.ID], comment)
+			c.Assert(info.Created.IsZero(), gc.Equals, false, comment)
+		}
+		c.Assert(ids, gc.DeepEquals, testCase.ids, comment)
+	}
+}
+
+func (s *objectSuite) TestRewrite(c *gc.C) {
+	c.Assert(s.storage.Put("a", []byte("a"), "a-ish"), gc.IsNil)
+	c.Assert(s.storage.Put("b", []byte("b"), "b-ish"), gc.IsNil)
+	var seen []string
+	err := s.storage.(oostore.ContentRewriter).Rewrite(func(id string, contents []byte) ([]byte, error) {
+		seen = append(seen, id+"="+string(contents))
+		if id == "b" {
+			return nil, nil
+		}
+		return []byte("rewritten"), nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(seen, gc.DeepEquals, []string{"a=a", "b=b"})
+	for id, expect := range map[string]string{"a": "rewritten", "b": "b"} {
+		contents, contentType, err := s.storage.Get(id)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, expect)
+		c.Assert(contentType, gc.Equals, id+"-ish")
+	}
+}
+
+func (s *objectSuite) TestCreateObject(c *gc.C) {
+	testCreateObject(c, s.db, s.storage)
+}
+
+// testCreateObject checks that an object and the root key of its macaroon
+// are stored together, or not at all.
+func testCreateObject(c *gc.C, db *sql.DB, storage oostore.Storage) {
+	bakeryStore, err := postgres.NewBakeryStorage(db)
+	c.Assert(err, gc.IsNil)
+	ac := storage.(oostore.AtomicCreator)
+
+	err = ac.CreateObject("foo", []byte("bar"), "bar-ish", "", func(txStore bakery.Storage) error {
+		return txStore.Put("root-key-foo", "item")
+	})
+	c.Assert(err, gc.IsNil)
+	contents, _, err := storage.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "bar")
+	item, err := bakeryStore.Get("root-key-foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "item")
+
+	err = ac.CreateObject("baz", []byte("quux"), "quux-ish", "", func(txStore bakery.Storage) error {
+		c.Assert(txStore.Put("root-key-baz", "item"), gc.IsNil)
+		return errgo.New("macaroon failed")
+	})
+	c.Assert(err, gc.ErrorMatches, "macaroon failed")
+	_, _, err = storage.Get("baz")
+	c.Assert(err, gc.Equals, oostore.ErrNotFound)
+	_, err = bakeryStore.Get("root-key-baz")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+
+	// Storing the object fails on the duplicate ID, so the root key is not
+	// stored either.
+	err = ac.CreateObject("foo", []byte("bar"), "bar-ish", "", func(txStore bakery.Storage) error {
+		return txStore.Put("root-key-foo2", "item")
+	})
+	c.Assert(err, gc.NotNil)
+	_, err = bakeryStore.Get("root-key-foo2")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
+
+func (s *objectSuite) TestConcurrentUsageTable(c *gc.C) {
+	c.Assert(s.storage.PutOwned("foo", []byte("foo"), "text/plain", "alice"), gc.IsNil)
+	c.Assert(s.storage.PutOwned("bar", []byte("barbar"), "text/plain", "bob"), gc.IsNil)
+	_, err := s.db.Exec(`DROP TABLE object_usage`)
+	c.Assert(err, gc.IsNil)
+
+	// Services starting together create and populate the usage table
+	// only once.
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := postgres.NewObjectStorage(s.db)
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		c.Assert(<-errs, gc.IsNil)
+	}
+	for owner, size := range map[string]int64{"": 9, "alice": 3, "bob": 6} {
+		usage, err := s.storage.Usage(owner)
+		c.Assert(err, gc.IsNil)
+		c.Assert(usage, gc.Equals, size, gc.Commentf("owner %q", owner))
+	}
+}
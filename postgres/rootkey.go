@@ -0,0 +1,175 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/cmars/oostore"
+)
+
+const createRootKeyTable = `CREATE TABLE IF NOT EXISTS root_key (
+	id      TEXT,
+	rootKey bytea NOT NULL,
+	created TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires TIMESTAMP WITH TIME ZONE NOT NULL,
+	PRIMARY KEY(id))`
+
+type rootKeyStorage struct {
+	db     *sql.DB
+	policy oostore.RootKeyPolicy
+	legacy *bakeryStorage
+
+	mu      sync.Mutex
+	current struct {
+		id      string
+		key     []byte
+		created time.Time
+	}
+}
+
+// NewRootKeyStorage returns a new PostgreSQL bakery.RootKeyStorage instance,
+// which rotates and expires root keys according to policy.
+//
+// Root keys for macaroons created with the storage returned by
+// NewBakeryStorage are still found, so that those macaroons keep verifying.
+// They do not expire.
+func NewRootKeyStorage(db *sql.DB, policy oostore.RootKeyPolicy) (*rootKeyStorage, error) {
+	legacy, err := NewBakeryStorage(db)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	st := &rootKeyStorage{
+		db:     db,
+		policy: policy,
+		legacy: legacy,
+	}
+	err = st.createIfNotExists()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return st, nil
+}
+
+// Get implements bakery.RootKeyStorage.
+func (s *rootKeyStorage) Get(id string) ([]byte, error) {
+	var key []byte
+	row := s.db.QueryRow(`SELECT rootKey FROM root_key WHERE id = $1 AND expires > $2`, id, time.Now().UTC())
+	err := row.Scan(&key)
+	if err == sql.ErrNoRows {
+		return s.getLegacy(id)
+	} else if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return key, nil
+}
+
+// getLegacy returns the root key stored in the bakery table for id.
+func (s *rootKeyStorage) getLegacy(id string) ([]byte, error) {
+	item, err := s.legacy.Get(id)
+	if err == bakery.ErrNotFound {
+		return nil, bakery.ErrNotFound
+	} else if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var doc struct {
+		RootKey []byte
+	}
+	err = json.Unmarshal([]byte(item), &doc)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid bakery item %q", id)
+	}
+	return doc.RootKey, nil
+}
+
+// RootKey implements bakery.RootKeyStorage. The most recent root key is
+// reused until the policy's generate interval has passed, at which point a
+// new one is generated and any expired keys are purged.
+func (s *rootKeyStorage) RootKey() ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if s.current.key != nil && now.Before(s.current.created.Add(s.policy.GenerateInterval)) {
+		return s.current.key, s.current.id, nil
+	}
+
+	// Another instance sharing the database may have generated a key
+	// recently enough.
+	row := s.db.QueryRow(`
+SELECT id, rootKey, created FROM root_key WHERE created > $1 ORDER BY created DESC LIMIT 1`,
+		now.Add(-s.policy.GenerateInterval))
+	err := row.Scan(&s.current.id, &s.current.key, &s.current.created)
+	if err == nil {
+		return s.current.key, s.current.id, nil
+	} else if err != sql.ErrNoRows {
+		s.current.key = nil
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+
+	err = s.generate(now)
+	if err != nil {
+		s.current.key = nil
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+	return s.current.key, s.current.id, nil
+}
+
+func (s *rootKeyStorage) generate(now time.Time) (_err error) {
+	key, err := oostore.NewRootKey()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var idBuf [16]byte
+	_, err = rand.Read(idBuf[:])
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	id := hex.EncodeToString(idBuf[:])
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	_, err = tx.Exec(`DELETE FROM root_key WHERE expires <= $1`, now)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	_, err = tx.Exec(`INSERT INTO root_key (id, rootKey, created, expires) VALUES ($1, $2, $3, $4)`,
+		id, key, now, s.policy.Expires(now))
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.current.id, s.current.key, s.current.created = id, key, now
+	return nil
+}
+
+func (s *rootKeyStorage) createIfNotExists() error {
+	_, err := s.db.Exec(createRootKeyTable)
+	return errgo.Mask(err, errgo.Any)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/cmars/oostore"
+	"github.com/cmars/oostore/postgres"
+)
+
+var _ = gc.Suite(&rootKeySuite{})
+
+type rootKeySuite struct {
+	postgresSuite
+}
+
+func (s *rootKeySuite) TestRotation(c *gc.C) {
+	store, err := postgres.NewRootKeyStorage(s.db, oostore.RootKeyPolicy{
+		GenerateInterval: time.Hour,
+		ExpiryDuration:   time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The current key is reused.
+	key1, id1, err := store.RootKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(key1, gc.HasLen, oostore.RootKeySize)
+	key, id, err := store.RootKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(id, gc.Equals, id1)
+	c.Assert(key, gc.DeepEquals, key1)
+
+	// Another instance sharing the database reuses it too.
+	other, err := postgres.NewRootKeyStorage(s.db, oostore.RootKeyPolicy{
+		GenerateInterval: time.Hour,
+		ExpiryDuration:   time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	_, id, err = other.RootKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(id, gc.Equals, id1)
+
+	// Age the key past its generate interval; a new one is generated, and
+	// the old one still verifies.
+	_, err = s.db.Exec(`UPDATE root_key SET created = created - interval '90 minutes'`)
+	c.Assert(err, gc.IsNil)
+	_, id2, err := other.RootKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(id2, gc.Not(gc.Equals), id1)
+	key, err = other.Get(id1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, key1)
+
+	// Expired keys are not found, and are purged when the next key is
+	// generated.
+	_, err = s.db.Exec(`UPDATE root_key SET created = created - interval '3 hours', expires = expires - interval '3 hours'`)
+	c.Assert(err, gc.IsNil)
+	_, err = other.Get(id1)
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	_, id3, err := other.RootKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(id3, gc.Not(gc.Equals), id2)
+	var count int
+	c.Assert(s.db.QueryRow(`SELECT COUNT(1) FROM root_key`).Scan(&count), gc.IsNil)
+	c.Assert(count, gc.Equals, 1)
+}
+
+func (s *rootKeySuite) TestLegacy(c *gc.C) {
+	legacy, err := postgres.NewBakeryStorage(s.db)
+	c.Assert(err, gc.IsNil)
+	c.Assert(legacy.Put("old-macaroon", `{"RootKey":"aGVsbG8="}`), gc.IsNil)
+
+	store, err := postgres.NewRootKeyStorage(s.db, oostore.RootKeyPolicy{
+		GenerateInterval: time.Hour,
+		ExpiryDuration:   time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	key, err := store.Get("old-macaroon")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(key), gc.Equals, "hello")
+	_, err = store.Get("never-seen-it")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
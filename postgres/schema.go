@@ -0,0 +1,63 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+)
+
+// column describes a table column by name and SQL type definition.
+type column struct {
+	name, def string
+}
+
+// addColumnIfNotExists adds a column to an existing table, if the table does
+// not already have it. PostgreSQL before 9.6 has no ADD COLUMN IF NOT EXISTS.
+func addColumnIfNotExists(db *sql.DB, table string, col column) error {
+	var count int
+	row := db.QueryRow(`
+SELECT COUNT(1) FROM information_schema.columns WHERE table_name = $1 AND column_name = $2`,
+		table, col.name)
+	err := row.Scan(&count)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, col.name, col.def))
+	return errgo.Mask(err, errgo.Any)
+}
+
+// createIndexIfNotExists creates an index, if one by the same name does not
+// already exist. PostgreSQL before 9.5 has no CREATE INDEX IF NOT EXISTS.
+func createIndexIfNotExists(db *sql.DB, name string, on string) error {
+	var count int
+	row := db.QueryRow(`SELECT COUNT(1) FROM pg_indexes WHERE indexname = $1`, name)
+	err := row.Scan(&count)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf(`CREATE INDEX %s ON %s`, name, on))
+	return errgo.Mask(err, errgo.Any)
+}
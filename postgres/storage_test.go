@@ -0,0 +1,50 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore/postgres"
+	"github.com/cmars/oostore/storagetest"
+)
+
+// storageSuite runs the storage conformance tests against the PostgreSQL
+// implementations.
+type storageSuite struct {
+	postgresSuite
+	storagetest.StorageSuite
+	dedup bool
+}
+
+var _ = gc.Suite(&storageSuite{})
+var _ = gc.Suite(&storageSuite{dedup: true})
+
+func (s *storageSuite) SetUpTest(c *gc.C) {
+	s.postgresSuite.SetUpTest(c)
+	var err error
+	if s.dedup {
+		s.Storage, err = postgres.NewDedupStorage(s.db)
+	} else {
+		s.Storage, err = postgres.NewObjectStorage(s.db)
+	}
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *storageSuite) TearDownTest(c *gc.C) {
+	s.postgresSuite.TearDownTest(c)
+}
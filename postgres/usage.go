@@ -0,0 +1,99 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Usage tables track the total size of the objects in an object storage
+// table by owner, so that it need not be summed on demand. The total of
+// everything stored is kept under the empty owner, which is never the owner
+// of an object. Transactions update the total, if at all, before any owner,
+// so that they always lock rows in the same order.
+const createUsageTable = `CREATE TABLE %s (
+	owner TEXT,
+	size  BIGINT NOT NULL,
+	PRIMARY KEY(owner))`
+
+// createUsageTableIfNotExists creates a usage table, if it does not already
+// exist, populated with the owners and total sizes selected by populate. An
+// advisory lock on the table name is held until the transaction completes,
+// so that services starting together don't both create and populate it.
+func createUsageTableIfNotExists(db *sql.DB, table string, populate string) (_err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer func() {
+		_err = completeTransaction(tx, _err)
+	}()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, table)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var count int
+	row := tx.QueryRow(`SELECT COUNT(1) FROM information_schema.tables WHERE table_name = $1`, table)
+	err = row.Scan(&count)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf(createUsageTable, table))
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (owner, size) %s`, table, populate))
+	return errgo.Mask(err, errgo.Any)
+}
+
+// addUsage adds delta to the size recorded for owner in a usage table.
+func addUsage(tx *sql.Tx, table string, owner string, delta int64) error {
+	_, err := tx.Exec(fmt.Sprintf(`
+INSERT INTO %[1]s (owner, size) VALUES ($1, $2)
+ON CONFLICT (owner) DO UPDATE SET size = %[1]s.size + EXCLUDED.size`, table), owner, delta)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// addTotalUsage adds delta to both the total size and the size recorded for
+// owner, if any, in a usage table.
+func addTotalUsage(tx *sql.Tx, table string, owner string, delta int64) error {
+	err := addUsage(tx, table, "", delta)
+	if err != nil || owner == "" {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(addUsage(tx, table, owner, delta), errgo.Any)
+}
+
+// getUsage returns the size recorded for owner in a usage table.
+func getUsage(db *sql.DB, table string, owner string) (int64, error) {
+	var size int64
+	row := db.QueryRow(fmt.Sprintf(`SELECT size FROM %s WHERE owner = $1`, table), owner)
+	err := row.Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	return size, nil
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// RateLimit allows a number of requests per period, in bursts of up to that
+// number. The zero value is unlimited.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRateLimit parses a rate limit of the form "N/duration", such as
+// "10/1s" or "100/1h". The number may be omitted from the duration, as in
+// "100/h".
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, errgo.Newf("invalid rate limit %q, expected N/duration", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 {
+		return RateLimit{}, errgo.Newf("invalid rate limit %q, expected a positive number of requests", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil {
+		per, err = time.ParseDuration("1" + parts[1])
+	}
+	if err != nil || per <= 0 {
+		return RateLimit{}, errgo.Newf("invalid rate limit %q, expected a positive duration", s)
+	}
+	return RateLimit{Requests: n, Per: per}, nil
+}
+
+// String returns the rate limit in the form parsed by ParseRateLimit.
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%v", l.Requests, l.Per)
+}
+
+// RouteRateLimits limits the requests made to a route.
+type RouteRateLimits struct {
+	// Client limits the requests from each client address.
+	Client RateLimit
+
+	// Macaroon limits the requests authorized by each macaroon issued,
+	// including those attenuated from it. It only applies to routes which
+	// check macaroons, and only counts requests which they authorize.
+	Macaroon RateLimit
+}
+
+// rateLimitRoutes are the names of the routes which may be rate limited.
+// Except for attenuate, inspect, collection and owner, which create new
+// collection and owner macaroons, each is named for the operation it
+// checks macaroons for. The object macaroon given to add is checked for
+// fetch.
+var rateLimitRoutes = map[string]bool{
+	"create":     true,
+	"fetch":      true,
+	"delete":     true,
+	"attenuate":  true,
+	"inspect":    true,
+	"collection": true,
+	"list":       true,
+	"add":        true,
+	"owner":      true,
+	"inventory":  true,
+}
+
+// condRateLimit is the condition of caveats which limit the requests
+// authorized by a macaroon, in addition to any limit of the service.
+const condRateLimit = "rate-limit"
+
+// rateLimitError is the cause of errors refusing requests which exceed a
+// rate limit.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+// Error implements error.
+func (e *rateLimitError) Error() string {
+	return "rate limit exceeded"
+}
+
+// sweepInterval is how often buckets which have refilled are discarded.
+const sweepInterval = time.Minute
+
+// rateLimiter keeps a token bucket for every client, macaroon and rate-limit
+// caveat which is limited.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *tokenBucket) refill(now time.Time) {
+	rate := float64(b.limit.Requests) / float64(b.limit.Per)
+	b.tokens = math.Min(float64(b.limit.Requests), b.tokens+rate*float64(now.Sub(b.last)))
+	b.last = now
+}
+
+// wait returns how long until the bucket will have a token.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	rate := float64(b.limit.Requests) / float64(b.limit.Per)
+	return time.Duration(math.Ceil((1 - b.tokens) / rate))
+}
+
+// limitedKey identifies the bucket of a request counted against a limit.
+type limitedKey struct {
+	key   string
+	limit RateLimit
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// take counts a request against the buckets of all the given keys, and
+// returns zero if every one of them allows it. Otherwise the request is not
+// counted against any of them, and take returns how long to wait until it
+// would be allowed. If dryRun is set, the request is not counted either
+// way.
+func (l *rateLimiter) take(keys []limitedKey, dryRun bool) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	var wait time.Duration
+	buckets := make([]*tokenBucket, len(keys))
+	for i, k := range keys {
+		key := k.limit.String() + " " + k.key
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{limit: k.limit, tokens: float64(k.limit.Requests), last: now}
+			l.buckets[key] = b
+		}
+		b.refill(now)
+		if w := b.wait(); w > wait {
+			wait = w
+		}
+		buckets[i] = b
+	}
+	if wait > 0 || dryRun {
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+// sweep discards the buckets which have refilled, as they are no different
+// from new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// rateLimit returns a handler which refuses requests to the route when a
+// client exceeds its limit, and otherwise calls h.
+func (s *Service) rateLimit(route string, h httprouter.Handle) httprouter.Handle {
+	limit := s.rateLimits[route].Client
+	if limit.Requests == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		wait := s.limiter.take([]limitedKey{{
+			key:   "client " + route + " " + s.clientAddr(r),
+			limit: limit,
+		}}, false)
+		if wait > 0 {
+			rateLimitedErrorf(w, &rateLimitError{retryAfter: wait})
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+// rateLimitCheck collects the rate limits of a macaroon being checked for
+// an operation.
+type rateLimitCheck struct {
+	// macaroonKey identifies the macaroon as issued, by its identifier
+	// and the object, collection or owner it was issued for.
+	macaroonKey string
+	keys        []limitedKey
+}
+
+// checkMacaroonLimits returns an error with a *rateLimitError cause if the
+// macaroon being checked has exceeded the limits collected in check, or the
+// service's limit for the operation. Otherwise the request is counted
+// against them, unless dryRun is set.
+func (s *Service) checkMacaroonLimits(check *rateLimitCheck, op string, dryRun bool) error {
+	keys := check.keys
+	if limit := s.rateLimits[op].Macaroon; limit.Requests > 0 {
+		keys = append(keys, limitedKey{
+			key:   "macaroon " + op + " " + check.macaroonKey,
+			limit: limit,
+		})
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	wait := s.limiter.take(keys, dryRun)
+	if wait > 0 {
+		return errgo.WithCausef(nil, &rateLimitError{retryAfter: wait}, "rate limit exceeded")
+	}
+	return nil
+}
+
+// rateLimitChecker checks that rate-limit caveats are well-formed, and
+// collects them to be counted once the macaroon has been verified, so that
+// requests with forged macaroons are not counted against the limits of
+// genuine ones. Macaroons attenuated from the same issued macaroon with the
+// same caveat share a limit, so that adding further caveats does not
+// escape it.
+func rateLimitChecker(check *rateLimitCheck) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: condRateLimit,
+		Check_: func(_, cav string) error {
+			limit, err := ParseRateLimit(cav)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			check.keys = append(check.keys, limitedKey{
+				key:   "caveat " + check.macaroonKey + " " + cav,
+				limit: limit,
+			})
+			return nil
+		},
+	}
+}
+
+// authErrorf writes the response to a request which was not authorized,
+// which is 429 Too Many Requests if a rate limit was exceeded, or 403
+// Forbidden otherwise.
+func authErrorf(w http.ResponseWriter, err error) {
+	if _, ok := errgo.Cause(err).(*rateLimitError); ok {
+		rateLimitedErrorf(w, err)
+		return
+	}
+	httpErrorf(w, http.StatusForbidden, err)
+}
+
+// rateLimitedErrorf writes a 429 Too Many Requests response, telling the
+// client how long to wait before trying again.
+func rateLimitedErrorf(w http.ResponseWriter, err error) {
+	if e, ok := errgo.Cause(err).(*rateLimitError); ok {
+		secs := int64(math.Ceil(e.retryAfter.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+	httpErrorf(w, http.StatusTooManyRequests, err)
+}
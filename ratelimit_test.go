@@ -0,0 +1,234 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// rateLimitServiceSuite tests a service which limits the rate of requests.
+// It does not run the other service tests, which make more requests than
+// it allows.
+type rateLimitServiceSuite struct {
+	svc serviceSuite
+}
+
+var _ = gc.Suite(&rateLimitServiceSuite{})
+
+func (s *rateLimitServiceSuite) SetUpTest(c *gc.C) {
+	s.svc.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		RateLimits: map[string]oostore.RouteRateLimits{
+			"create": {Client: oostore.RateLimit{Requests: 3, Per: time.Hour}},
+			"fetch":  {Macaroon: oostore.RateLimit{Requests: 2, Per: time.Hour}},
+		},
+	})
+}
+
+func (s *rateLimitServiceSuite) TearDownTest(c *gc.C) {
+	s.svc.TearDownTest(c)
+}
+
+func (s *rateLimitServiceSuite) create(c *gc.C) (string, []byte) {
+	resp, err := http.Post(s.svc.server.URL, "text/plain", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	return resp.Header.Get("Location"), auth
+}
+
+func (s *rateLimitServiceSuite) fetch(c *gc.C, loc string, auth []byte) *http.Response {
+	resp, err := http.Post(s.svc.server.URL+loc, "application/json", bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	return resp
+}
+
+func (s *rateLimitServiceSuite) TestClientLimit(c *gc.C) {
+	for i := 0; i < 3; i++ {
+		s.create(c)
+	}
+	resp, err := http.Post(s.svc.server.URL, "text/plain", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(retryAfter > 1000 && retryAfter <= 1200, gc.Equals, true, gc.Commentf("Retry-After %d", retryAfter))
+}
+
+func (s *rateLimitServiceSuite) TestMacaroonLimit(c *gc.C) {
+	loc, auth := s.create(c)
+	otherLoc, otherAuth := s.create(c)
+
+	// Requests which are not authorized don't count.
+	resp := s.fetch(c, loc, withCaveat(c, auth, "operation delete"))
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+	for i := 0; i < 2; i++ {
+		resp = s.fetch(c, loc, auth)
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	}
+	resp = s.fetch(c, loc, auth)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Header.Get("Retry-After"), gc.Not(gc.Equals), "")
+	// Attenuating the macaroon does not escape the limit.
+	resp = s.fetch(c, loc, withCaveat(c, auth, "operation fetch"))
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+
+	// Other macaroons have limits of their own, and deleting is not
+	// limited.
+	resp = s.fetch(c, otherLoc, otherAuth)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	req, err := http.NewRequest("DELETE", s.svc.server.URL+loc, bytes.NewBuffer(auth))
+	c.Assert(err, gc.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent)
+}
+
+func (s *rateLimitServiceSuite) TestRateLimitCaveat(c *gc.C) {
+	loc, auth := s.create(c)
+	resp := s.svc.attenuate(c, auth, "rate-limit 1/1h")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	limited, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	inspect := func() *oostore.Inspection {
+		resp, err := http.Post(s.svc.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(limited))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		var insp oostore.Inspection
+		c.Assert(json.NewDecoder(resp.Body).Decode(&insp), gc.IsNil)
+		return &insp
+	}
+
+	// Inspecting the macaroon does not count against its limit.
+	c.Assert(inspect().Verified["fetch"], gc.Equals, true)
+	resp = s.fetch(c, loc, limited)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	resp = s.fetch(c, loc, limited)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	resp = s.fetch(c, loc, withCaveat(c, limited, "operation fetch"))
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	insp := inspect()
+	c.Assert(insp.Verified["fetch"], gc.Equals, false)
+	c.Assert(insp.Errors["fetch"], gc.Equals, "rate limit exceeded")
+
+	// The macaroon it was attenuated from is only subject to the service
+	// limit.
+	resp = s.fetch(c, loc, auth)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *rateLimitServiceSuite) TestRootKeyStoreLimits(c *gc.C) {
+	s.svc.TearDownTest(c)
+	s.svc.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		RootKeyStore: oostore.NewMemRootKeyStorage(oostore.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   time.Hour,
+		}),
+		RateLimits: map[string]oostore.RouteRateLimits{
+			"fetch": {Macaroon: oostore.RateLimit{Requests: 2, Per: time.Hour}},
+		},
+	})
+	loc, auth := s.create(c)
+	otherLoc, otherAuth := s.create(c)
+	var ms, otherMs macaroon.Slice
+	c.Assert(json.Unmarshal(auth, &ms), gc.IsNil)
+	c.Assert(json.Unmarshal(otherAuth, &otherMs), gc.IsNil)
+	c.Assert(ms[0].Id(), gc.Equals, otherMs[0].Id())
+
+	// Macaroons for different objects sharing a root key have limits of
+	// their own, both of the service and of their caveats.
+	for i := 0; i < 2; i++ {
+		resp := s.fetch(c, loc, auth)
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	}
+	resp := s.fetch(c, loc, auth)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	resp = s.fetch(c, otherLoc, otherAuth)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	loc, auth = s.create(c)
+	limited := withCaveat(c, auth, "rate-limit 1/1h")
+	otherLoc, otherAuth = s.create(c)
+	otherLimited := withCaveat(c, otherAuth, "rate-limit 1/1h")
+	resp = s.fetch(c, otherLoc, otherLimited)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	resp = s.fetch(c, otherLoc, otherLimited)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	resp = s.fetch(c, loc, limited)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *rateLimitServiceSuite) TestInvalidRateLimits(c *gc.C) {
+	_, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		RateLimits: map[string]oostore.RouteRateLimits{
+			"frobnicate": {Client: oostore.RateLimit{Requests: 1, Per: time.Second}},
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot rate limit unknown route "frobnicate"`)
+	_, err = oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		RateLimits: map[string]oostore.RouteRateLimits{
+			"fetch": {Macaroon: oostore.RateLimit{Requests: 1}},
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid rate limit 1/0s for route "fetch"`)
+}
+
+func (s *rateLimitServiceSuite) TestParseRateLimit(c *gc.C) {
+	for i, test := range []struct {
+		s      string
+		expect oostore.RateLimit
+		err    string
+	}{
+		{s: "10/1s", expect: oostore.RateLimit{Requests: 10, Per: time.Second}},
+		{s: "100/h", expect: oostore.RateLimit{Requests: 100, Per: time.Hour}},
+		{s: "5/90m", expect: oostore.RateLimit{Requests: 5, Per: 90 * time.Minute}},
+		{s: "10", err: `invalid rate limit "10", expected N/duration`},
+		{s: "0/1s", err: `invalid rate limit "0/1s", expected a positive number of requests`},
+		{s: "1/often", err: `invalid rate limit "1/often", expected a positive duration`},
+		{s: "1/-1s", err: `invalid rate limit "1/-1s", expected a positive duration`},
+	} {
+		comment := gc.Commentf("test#%d: %s", i, test.s)
+		limit, err := oostore.ParseRateLimit(test.s)
+		if test.err != "" {
+			c.Assert(err, gc.ErrorMatches, test.err, comment)
+			continue
+		}
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(limit, gc.Equals, test.expect, comment)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// Caveat conditions which restrict the properties of requests sent by web
+// browsers. Other clients can set these headers to anything they like.
+const (
+	// condOrigin restricts the Origin header to any of a comma-separated
+	// list of origins.
+	condOrigin = "origin"
+
+	// condRefererPrefix restricts the Referer header to URLs beginning
+	// with a prefix.
+	condRefererPrefix = "referer-prefix"
+
+	// condHeader restricts a request header, given as "Name=value", to a
+	// value.
+	condHeader = "header"
+)
+
+// parseOrigins parses a comma-separated list of origins, such as
+// "https://app.example.com".
+func parseOrigins(s string) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimSpace(origin)
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid origin %q", origin)
+		}
+		origins = append(origins, strings.ToLower(origin))
+	}
+	return origins, nil
+}
+
+// validateRefererPrefix checks that a referer prefix is an absolute URL
+// including a path, so that a prefix can't match another host whose name
+// begins with the same host name.
+func validateRefererPrefix(prefix string) error {
+	u, err := url.Parse(prefix)
+	if err != nil || u.Scheme == "" || u.Host == "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("invalid referer prefix %q, expected a URL with a path", prefix)
+	}
+	return nil
+}
+
+// parseHeaderCaveat parses the argument of a header caveat into the header
+// name and value.
+func parseHeaderCaveat(arg string) (string, string, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t:") {
+		return "", "", fmt.Errorf("invalid header caveat %q, expected Name=value", arg)
+	}
+	return http.CanonicalHeaderKey(parts[0]), parts[1], nil
+}
+
+// requestCheckers returns checkers for the origin, referer-prefix and header
+// caveats on the request.
+func requestCheckers(r *http.Request) checkers.Checker {
+	return checkers.Map{
+		condOrigin: func(_, arg string) error {
+			origins, err := parseOrigins(arg)
+			if err != nil {
+				return err
+			}
+			origin := strings.ToLower(r.Header.Get("Origin"))
+			for _, allowed := range origins {
+				if origin == allowed {
+					return nil
+				}
+			}
+			return fmt.Errorf("origin %q not allowed", r.Header.Get("Origin"))
+		},
+		condRefererPrefix: func(_, arg string) error {
+			err := validateRefererPrefix(arg)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(r.Referer(), arg) {
+				return fmt.Errorf("referer %q not allowed", r.Referer())
+			}
+			return nil
+		},
+		condHeader: func(_, arg string) error {
+			name, value, err := parseHeaderCaveat(arg)
+			if err != nil {
+				return err
+			}
+			for _, v := range r.Header[name] {
+				if v == value {
+					return nil
+				}
+			}
+			return fmt.Errorf("header %s does not match", name)
+		},
+	}
+}
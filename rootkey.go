@@ -0,0 +1,122 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+)
+
+// RootKeySize is the size in bytes of the macaroon root keys generated by
+// root key storage.
+const RootKeySize = 24
+
+// RootKeyPolicy determines how long macaroon root keys are used and kept.
+type RootKeyPolicy struct {
+	// GenerateInterval is how long a root key is used to create new
+	// macaroons before another is generated.
+	GenerateInterval time.Duration
+
+	// ExpiryDuration is how long a root key remains valid after it was
+	// last used to create a macaroon. Macaroons stop verifying when their
+	// root key expires, so this bounds how long any macaroon is honored.
+	ExpiryDuration time.Duration
+}
+
+// Expires returns when a root key created at the given time expires.
+func (p RootKeyPolicy) Expires(created time.Time) time.Time {
+	return created.Add(p.GenerateInterval + p.ExpiryDuration)
+}
+
+// NewRootKey returns new random root key material.
+func NewRootKey() ([]byte, error) {
+	key := make([]byte, RootKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+type rootKeyDoc struct {
+	Key     []byte
+	Created time.Time
+	Expires time.Time
+}
+
+type memRootKeyStorage struct {
+	mu        sync.Mutex
+	policy    RootKeyPolicy
+	keys      map[string]rootKeyDoc
+	currentID string
+}
+
+// NewMemRootKeyStorage returns a new bakery.RootKeyStorage that only keeps
+// root keys in memory, rotating and expiring them according to policy.
+func NewMemRootKeyStorage(policy RootKeyPolicy) *memRootKeyStorage {
+	return &memRootKeyStorage{
+		policy: policy,
+		keys:   make(map[string]rootKeyDoc),
+	}
+}
+
+// Get implements bakery.RootKeyStorage.
+func (s *memRootKeyStorage) Get(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.keys[id]
+	if !ok || !time.Now().Before(doc.Expires) {
+		return nil, bakery.ErrNotFound
+	}
+	return doc.Key, nil
+}
+
+// RootKey implements bakery.RootKeyStorage. The current root key is reused
+// until the policy's generate interval has passed, at which point a new one
+// is generated and any expired keys are purged.
+func (s *memRootKeyStorage) RootKey() ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if doc, ok := s.keys[s.currentID]; ok && now.Before(doc.Created.Add(s.policy.GenerateInterval)) {
+		return doc.Key, s.currentID, nil
+	}
+	for id, doc := range s.keys {
+		if !now.Before(doc.Expires) {
+			delete(s.keys, id)
+		}
+	}
+	key, err := NewRootKey()
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	s.keys[id] = rootKeyDoc{
+		Key:     key,
+		Created: now,
+		Expires: s.policy.Expires(now),
+	}
+	s.currentID = id
+	return key, id, nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// rootKeyServiceSuite runs the service tests with rotating root keys.
+type rootKeyServiceSuite struct {
+	serviceSuite
+}
+
+var _ = gc.Suite(&rootKeyServiceSuite{})
+
+func (s *rootKeyServiceSuite) SetUpTest(c *gc.C) {
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		RootKeyStore: oostore.NewMemRootKeyStorage(oostore.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   time.Hour,
+		}),
+	})
+}
+
+func (s *rootKeyServiceSuite) TestRootKeyExpiry(c *gc.C) {
+	s.TearDownTest(c)
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		RootKeyStore: oostore.NewMemRootKeyStorage(oostore.RootKeyPolicy{
+			GenerateInterval: 100 * time.Millisecond,
+			ExpiryDuration:   100 * time.Millisecond,
+		}),
+	})
+	cl := &http.Client{}
+	create := func() (string, []byte) {
+		resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		var mjson bytes.Buffer
+		_, err = io.Copy(&mjson, resp.Body)
+		c.Assert(err, gc.IsNil)
+		return resp.Header.Get("Location"), mjson.Bytes()
+	}
+	fetch := func(loc string, auth []byte) int {
+		resp, err := cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(auth))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	macaroonID := func(auth []byte) string {
+		var ms macaroon.Slice
+		c.Assert(json.Unmarshal(auth, &ms), gc.IsNil)
+		return ms[0].Id()
+	}
+
+	// Macaroons created together share a root key.
+	loc1, auth1 := create()
+	loc2, auth2 := create()
+	c.Assert(macaroonID(auth1), gc.Equals, macaroonID(auth2))
+
+	// Once the generate interval passes, a new root key is used, and the
+	// old one still verifies.
+	time.Sleep(120 * time.Millisecond)
+	loc3, auth3 := create()
+	c.Assert(macaroonID(auth3), gc.Not(gc.Equals), macaroonID(auth1))
+	c.Assert(fetch(loc1, auth1), gc.Equals, http.StatusOK)
+
+	// Once the old root key expires, its macaroons are no longer honored.
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(fetch(loc2, auth2), gc.Equals, http.StatusForbidden)
+	c.Assert(fetch(loc3, auth3), gc.Equals, http.StatusOK)
+}
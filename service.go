@@ -23,9 +23,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"gopkg.in/errgo.v1"
@@ -37,11 +40,30 @@ import (
 
 const idLen = 32
 
+// apiPath is the path segment, under the service prefix, reserved for
+// requests that do not operate on a single object. Object IDs are always
+// longer than this, so the two can never be confused.
+const apiPath = "_"
+
 // Service provides an HTTP API for opaque object storage.
 type Service struct {
-	bakery *bakery.Service
-	store  Storage
-	router *httprouter.Router
+	bakery      *bakery.Service
+	bakeryKey   *bakery.KeyPair
+	bakeryStore bakery.Storage
+	store       Storage
+	collections CollectionStorage
+	objectKeys  bool
+	metrics     *Metrics
+	audit       AuditSink
+	limits      Limits
+	rateLimits  map[string]RouteRateLimits
+	limiter     *rateLimiter
+	holderSigs  *holderSignatureCache
+	proxies     []*net.IPNet
+	allowCORS   bool
+	router      *httprouter.Router
+	apiPrefix   string
+	apiRouter   *httprouter.Router
 }
 
 // ServiceConfig contains the items needed to create a new Service.
@@ -49,6 +71,49 @@ type ServiceConfig struct {
 	BakeryStore bakery.Storage
 	ObjectStore Storage
 	Prefix      string
+
+	// CollectionStore is optional. If not set, collections are not
+	// supported.
+	CollectionStore CollectionStorage
+
+	// ObjectKeys, if set, encrypts the contents of each new object with a
+	// key of its own, which is carried in a caveat on the object macaroon
+	// and not stored by the service. Such objects can only be fetched by
+	// presenting that macaroon, and cannot be added to collections.
+	ObjectKeys bool
+
+	// RootKeyStore is optional. If set, it provides the root keys for
+	// macaroons, shared between macaroons created at around the same time,
+	// and BakeryStore is not used.
+	RootKeyStore bakery.RootKeyStorage
+
+	// Metrics is optional. If set, it collects metrics about requests and
+	// object storage calls, to be served by the caller.
+	Metrics *Metrics
+
+	// AuditSink is optional. If set, it records the authorization decision
+	// made for every request to create, fetch or delete an object.
+	AuditSink AuditSink
+
+	// Limits restricts the size of objects and how much may be stored.
+	Limits Limits
+
+	// RateLimits is optional. It limits the requests made to each route,
+	// keyed by route name: create, fetch and delete for objects,
+	// attenuate and inspect, collection, list and add for collections, and
+	// owner and inventory for owners.
+	RateLimits map[string]RouteRateLimits
+
+	// TrustedProxies are the networks of proxies trusted to give the
+	// address of the client they forward requests for, in the Forwarded
+	// or X-Forwarded-For header. Client addresses are taken from these
+	// headers only for requests from trusted proxies.
+	TrustedProxies []*net.IPNet
+
+	// CORS allows web pages from any origin to make cross-origin
+	// requests. Origin caveats restrict the origins a macaroon may be used
+	// from.
+	CORS bool
 }
 
 // ErrNotFound indicates that the requested content ID was not found.
@@ -63,21 +128,92 @@ type Storage interface {
 	// Put stores new content for the given ID.
 	Put(id string, contents []byte, contentType string) error
 
+	// PutOwned stores new content for the given ID, recording owner as its
+	// creator. An empty owner is the same as Put.
+	PutOwned(id string, contents []byte, contentType string, owner string) error
+
 	// Delete removes content by ID.
 	Delete(id string) error
+
+	// List returns information about up to limit objects created by owner,
+	// ordered by ID, starting after the given ID. An empty after starts
+	// from the beginning.
+	List(owner string, after string, limit int) ([]ObjectInfo, error)
+
+	// Usage returns the total size in bytes of the objects created by
+	// owner, or of everything stored if owner is empty. Sizes are as
+	// stored, like those returned by List, and implementations which store
+	// identical contents once count them once in the total.
+	Usage(owner string) (int64, error)
+}
+
+// AtomicCreator is implemented by Storage backends which can store a new
+// object together with the root key of its macaroon, so that neither is
+// stored without the other.
+type AtomicCreator interface {
+	// CreateObject stores a new object like PutOwned, and calls
+	// newMacaroon with bakery storage in which to keep the root key of the
+	// object's macaroon. If either fails, neither is stored.
+	CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error
+}
+
+// ErrNotAtomic is returned by CreateObject implementations which wrap
+// another Storage, when the wrapped Storage is not an AtomicCreator.
+var ErrNotAtomic = fmt.Errorf("atomic creation not supported")
+
+// ObjectInfo describes a stored object, without its contents.
+type ObjectInfo struct {
+	ID          string    `json:"id"`
+	ContentType string    `json:"content-type"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
 }
 
 // NewService creates a new opaque object storage service.
 func NewService(config ServiceConfig) (*Service, error) {
+	bakeryStore := config.BakeryStore
+	if config.RootKeyStore != nil {
+		bakeryStore = nil
+	} else if bakeryStore == nil {
+		bakeryStore = bakery.NewMemStorage()
+	}
+	for route, limits := range config.RateLimits {
+		if !rateLimitRoutes[route] {
+			return nil, errgo.Newf("cannot rate limit unknown route %q", route)
+		}
+		for _, limit := range []RateLimit{limits.Client, limits.Macaroon} {
+			if limit.Requests < 0 || limit.Requests > 0 && limit.Per <= 0 {
+				return nil, errgo.Newf("invalid rate limit %v for route %q", limit, route)
+			}
+		}
+	}
+	bakeryKey, err := bakery.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
 	bakeryService, err := bakery.NewService(bakery.NewServiceParams{
-		Store: config.BakeryStore,
+		Store:        bakeryStore,
+		RootKeyStore: config.RootKeyStore,
+		Key:          bakeryKey,
 	})
 	if err != nil {
 		return nil, err
 	}
 	s := &Service{
-		bakery: bakeryService,
-		store:  config.ObjectStore,
+		bakery:      bakeryService,
+		bakeryKey:   bakeryKey,
+		bakeryStore: bakeryStore,
+		store:       config.Metrics.instrumentStorage(config.ObjectStore),
+		collections: config.CollectionStore,
+		objectKeys:  config.ObjectKeys,
+		metrics:     config.Metrics,
+		audit:       config.AuditSink,
+		limits:      config.Limits,
+		rateLimits:  config.RateLimits,
+		limiter:     newRateLimiter(),
+		holderSigs:  newHolderSignatureCache(),
+		proxies:     config.TrustedProxies,
+		allowCORS:   config.CORS,
 	}
 
 	prefix := "/"
@@ -85,14 +221,35 @@ func NewService(config ServiceConfig) (*Service, error) {
 		prefix = config.Prefix
 	}
 	s.router = httprouter.New()
-	s.router.POST(prefix, s.create)
-	s.router.POST(path.Join(prefix, ":object"), s.fetch)
-	s.router.DELETE(path.Join(prefix, ":object"), s.del)
+	s.router.POST(prefix, s.metrics.instrument("create", s.rateLimit("create", s.create)))
+	s.router.POST(path.Join(prefix, ":object"), s.metrics.instrument("fetch", s.rateLimit("fetch", s.fetch)))
+	s.router.DELETE(path.Join(prefix, ":object"), s.metrics.instrument("delete", s.rateLimit("delete", s.del)))
+
+	// httprouter will not allow static paths alongside the :object
+	// wildcard, so everything else gets its own router.
+	s.apiPrefix = path.Join(prefix, apiPath) + "/"
+	s.apiRouter = httprouter.New()
+	s.apiRouter.POST(s.apiPrefix+"attenuate", s.rateLimit("attenuate", s.attenuate))
+	s.apiRouter.POST(s.apiPrefix+"inspect", s.rateLimit("inspect", s.inspect))
+	if s.collections != nil {
+		s.apiRouter.POST(s.apiPrefix+"collection", s.rateLimit("collection", s.createCollection))
+		s.apiRouter.POST(s.apiPrefix+"collection/:collection", s.rateLimit("list", s.listCollection))
+		s.apiRouter.PUT(s.apiPrefix+"collection/:collection/:object", s.rateLimit("add", s.addToCollection))
+	}
+	s.apiRouter.POST(s.apiPrefix+"owner", s.rateLimit("owner", s.createOwner))
+	s.apiRouter.POST(s.apiPrefix+"owner/objects", s.rateLimit("inventory", s.inventory))
 	return s, nil
 }
 
 // ServeHTTP implements net/http.Handler.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.cors(w, r) {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, s.apiPrefix) {
+		s.apiRouter.ServeHTTP(w, r)
+		return
+	}
 	s.router.ServeHTTP(w, r)
 }
 
@@ -118,8 +275,11 @@ func newID() (string, error) {
 // create handles the request to store new content, responding with a macaroon
 // that can later be used to fetch or delete it.
 func (s *Service) create(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	contents, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	contents, err := s.readObject(r)
+	if errgo.Cause(err) == errTooLarge {
+		httpErrorf(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil {
 		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to read request body"))
 		return
 	}
@@ -134,117 +294,447 @@ func (s *Service) create(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create an object ID"))
 		return
 	}
-	w.Header().Set("Location", r.URL.Path+id)
 
-	err = s.store.Put(id, contents, contentType)
-	if err != nil {
-		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to store content"))
-		return
+	rec := s.newAuditRecord(r, "create", id)
+	var owner string
+	if r.Header.Get(ownerHeader) != "" {
+		owner, err = s.checkOwner(r, contents, "create", rec)
+		if err != nil {
+			s.recordAudit(rec, err)
+			authErrorf(w, err)
+			return
+		}
+	}
+	// The decision is recorded once the object has been created, so that
+	// creates refused for their size, or which fail, are not recorded as
+	// allowed.
+	size := len(contents)
+	var key []byte
+	if s.objectKeys {
+		key, err = newObjectKey()
+		if err != nil {
+			err = errgo.Notef(err, "failed to create an object key")
+			s.recordAudit(rec, err)
+			httpErrorf(w, http.StatusInternalServerError, err)
+			return
+		}
+		contents, err = sealObject(key, id, contents)
+		if err != nil {
+			err = errgo.Notef(err, "failed to encrypt content")
+			s.recordAudit(rec, err)
+			httpErrorf(w, http.StatusInternalServerError, err)
+			return
+		}
 	}
 
-	m, err := s.bakery.NewMacaroon("", nil, nil)
-	if err != nil {
-		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to create macaroon"))
+	err = s.checkQuota(owner, int64(len(contents)))
+	if errgo.Cause(err) == errTooLarge {
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil {
+		err = errgo.Notef(err, "failed to check quota")
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusInternalServerError, err)
 		return
 	}
-	err = s.bakery.AddCaveat(m, checkers.Caveat{Condition: fmt.Sprintf("object %s", id)})
+
+	m, err := s.createObject(id, contents, contentType, owner, key)
 	if err != nil {
-		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to add caveat"))
+		err = errgo.Notef(err, "failed to create object")
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusInternalServerError, err)
 		return
 	}
+	s.recordAudit(rec, nil)
+	s.metrics.stored(size)
+	w.Header().Set("Location", r.URL.Path+id)
 
 	ms := macaroon.Slice{m}
 	err = json.NewEncoder(w).Encode(ms)
 	if err != nil {
-		log.Println("failed to write response: %v", err)
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// ObjectMacaroonID returns the identifier of the macaroon issued for a new
+// object, under which its root key is kept in bakery storage. Macaroons
+// issued with a RootKeyStore share their root key's identifier instead.
+func ObjectMacaroonID(id string) string {
+	return ObjectMacaroonIDPrefix + id
+}
+
+// ObjectMacaroonIDPrefix prefixes the object ID in the identifier of an
+// object macaroon.
+const ObjectMacaroonIDPrefix = "object-"
+
+// newObjectMacaroon returns a new macaroon for object id. If key is not nil,
+// the macaroon carries it as the object key.
+func (s *Service) newObjectMacaroon(svc *bakery.Service, id string, key []byte) (*macaroon.Macaroon, error) {
+	var macaroonID string
+	if s.bakeryStore != nil {
+		macaroonID = ObjectMacaroonID(id)
+	}
+	caveats := []checkers.Caveat{{Condition: fmt.Sprintf("object %s", id)}}
+	if key != nil {
+		caveats = append(caveats, objectKeyCaveat(key))
+	}
+	m, err := svc.NewMacaroon(macaroonID, nil, caveats)
+	return m, errgo.Mask(err, errgo.Any)
+}
+
+// createObject stores a new object and returns a macaroon for it. If the
+// object storage supports it, the object and the macaroon's root key are
+// stored atomically. Otherwise the macaroon is created first, so that the
+// object is never left without a macaroon to reach it, and its root key is
+// removed if the object can't be stored.
+func (s *Service) createObject(id string, contents []byte, contentType string, owner string, key []byte) (*macaroon.Macaroon, error) {
+	if ac, ok := s.store.(AtomicCreator); ok && s.bakeryStore != nil {
+		var m *macaroon.Macaroon
+		err := ac.CreateObject(id, contents, contentType, owner, func(bakeryStore bakery.Storage) error {
+			svc, err := bakery.NewService(bakery.NewServiceParams{
+				Location: s.bakery.Location(),
+				Store:    bakeryStore,
+				Key:      s.bakeryKey,
+			})
+			if err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+			m, err = s.newObjectMacaroon(svc, id, key)
+			return errgo.Mask(err, errgo.Any)
+		})
+		if err != ErrNotAtomic {
+			return m, errgo.Mask(err, errgo.Any)
+		}
+	}
+
+	m, err := s.newObjectMacaroon(s.bakery, id, key)
+	if err != nil {
+		return nil, errgo.Notef(err, "failed to create macaroon")
+	}
+	err = s.store.PutOwned(id, contents, contentType, owner)
+	if err != nil {
+		s.deleteObjectMacaroon(id)
+		return nil, errgo.Notef(err, "failed to store content")
+	}
+	return m, nil
+}
+
+// deleteObjectMacaroon removes the root key of the macaroon issued for
+// object id, when the object could not be stored. Failures are only logged,
+// as orphaned root keys are removed by garbage collection.
+//
+// Root keys are not removed when objects are deleted, so that the service
+// can still tell holders of their macaroons that the object is gone, until
+// garbage collection.
+func (s *Service) deleteObjectMacaroon(id string) {
+	if s.bakeryStore == nil {
+		return
+	}
+	err := s.bakeryStore.Del(ObjectMacaroonID(id))
+	if err != nil && err != bakery.ErrNotFound {
+		log.Printf("failed to delete root key for %q: %v", id, err)
 	}
 }
 
 type authInfo struct {
-	object   string
-	declared map[string]string
+	object    string
+	declared  map[string]string
+	objectKey []byte
+
+	// contentTypes are the media ranges of each content-type caveat, which
+	// the content type of a fetched object must match.
+	contentTypes [][]string
 }
 
 type requestInfo struct {
 	request   *http.Request
 	params    httprouter.Params
 	operation string
+
+	// audit, if not nil, is the audit record of the request, to which the
+	// macaroon identifier and the caveats checked are added.
+	audit *AuditRecord
+
+	// dryRun, if set, checks rate limits without counting the request
+	// against them.
+	dryRun bool
+
+	// rateLimit collects the rate limits of the macaroon being checked.
+	rateLimit *rateLimitCheck
+
+	// body is the body of the request, which holder signatures cover.
+	body []byte
+
+	// holderSigs collects the holder signatures accepted.
+	holderSigs *holderSignatureCheck
+}
+
+// readJSON decodes the JSON request body into v, and returns the body as it
+// was read.
+func readJSON(r *http.Request, v interface{}) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return body, errgo.Mask(json.Unmarshal(body, v))
 }
 
 func (s *Service) checkRequest(info requestInfo) (*authInfo, error) {
 	var ms macaroon.Slice
-	err := json.NewDecoder(info.request.Body).Decode(&ms)
+	body, err := readJSON(info.request, &ms)
 	if err != nil {
+		s.metrics.authFailure(authFailureInvalidRequest)
 		return nil, errgo.Mask(err, errgo.Any)
 	}
+	info.body = body
+	auth, err := s.checkMacaroons(ms, info)
+	return auth, errgo.Mask(err, errgo.Any)
+}
+
+// checkMacaroons checks that the macaroons authorize the request described by
+// info, counting refusals in the metrics unless info.dryRun is set, so that
+// inspecting macaroons is not counted as refused requests.
+func (s *Service) checkMacaroons(ms macaroon.Slice, info requestInfo) (*authInfo, error) {
+	auth, failure, err := s.verifyMacaroons(ms, info)
+	if err != nil {
+		if !info.dryRun {
+			s.metrics.authFailure(failure)
+		}
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return auth, nil
+}
+
+// verifyMacaroons checks that the macaroons authorize the request described
+// by info. If they don't, the reason for the failure is returned along with
+// the error.
+func (s *Service) verifyMacaroons(ms macaroon.Slice, info requestInfo) (*authInfo, string, error) {
+	if len(ms) == 0 {
+		return nil, authFailureNoMacaroons, errgo.New("no macaroons")
+	}
 	declared := checkers.InferDeclared(ms)
 	// TODO: assert any declared caveats here
-	err = s.bakery.Check(ms, checkers.New(declared, newCheckers(info)))
+	info.rateLimit = &rateLimitCheck{macaroonKey: ms[0].Id() + " " + issuedFor(ms[0])}
+	info.holderSigs = &holderSignatureCheck{macaroonSig: ms[0].Signature(), body: info.body}
+	var checker bakery.FirstPartyChecker = checkers.New(declared, s.newCheckers(info))
+	if info.audit != nil {
+		info.audit.MacaroonID = ms[0].Id()
+		info.audit.IssuedFor = issuedFor(ms[0])
+		checker = auditChecker{checker, info.audit}
+	}
+	err := s.bakery.Check(ms, checker)
 	if err != nil {
-		return nil, errgo.Mask(err, errgo.Any)
+		if _, ok := err.(*bakery.VerificationError); ok {
+			return nil, authFailureVerification, errgo.Mask(err, errgo.Any)
+		}
+		return nil, authFailureError, errgo.Mask(err, errgo.Any)
+	}
+	err = s.holderSigs.use(info.holderSigs.used, info.dryRun)
+	if err != nil {
+		return nil, authFailureReplayed, errgo.Mask(err, errgo.Any)
+	}
+	err = s.checkMacaroonLimits(info.rateLimit, info.operation, info.dryRun)
+	if err != nil {
+		return nil, authFailureRateLimited, errgo.Mask(err, errgo.Any)
+	}
+	key, err := objectKey(ms)
+	if err != nil {
+		return nil, authFailureObjectKey, errgo.Mask(err)
 	}
 
 	return &authInfo{
-		object:   info.params.ByName("object"),
-		declared: declared,
-	}, nil
+		object:       info.params.ByName("object"),
+		declared:     declared,
+		objectKey:    key,
+		contentTypes: contentTypeCaveats(ms),
+	}, "", nil
+}
+
+// issuedFor returns the first first-party caveat of m, which the service
+// adds when issuing a macaroon to name the object, collection or owner it
+// is for. Macaroons issued with a RootKeyStore share their root key's
+// identifier, so it is needed alongside the identifier to tell them apart.
+// Attenuating a macaroon only adds caveats after it, so attenuated
+// macaroons are issued for the same thing as those they came from.
+func issuedFor(m *macaroon.Macaroon) string {
+	for _, cav := range m.Caveats() {
+		if cav.Location == "" {
+			return cav.Id
+		}
+	}
+	return ""
 }
 
 // fetch handles the request to fetch the content authorized by the given
 // macaroon.
 func (s *Service) fetch(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	auth, err := s.checkRequest(requestInfo{request: r, params: p, operation: "fetch"})
+	rec := s.newAuditRecord(r, "fetch", p.ByName("object"))
+	auth, err := s.checkRequest(requestInfo{request: r, params: p, operation: "fetch", audit: rec})
 	if err != nil {
-		httpErrorf(w, http.StatusForbidden, err)
+		s.recordAudit(rec, err)
+		authErrorf(w, err)
 		return
 	}
 
-	contents, contentType, err := s.store.Get(auth.object)
+	var contents []byte
+	var contentType, encoding string
+	if auth.objectKey != nil {
+		contents, contentType, err = s.store.Get(auth.object)
+	} else {
+		contents, contentType, encoding, err = s.getContents(w, r, auth.object)
+	}
 	if err != nil {
-		httpErrorf(w, http.StatusNotFound, errgo.Newf("not found: %q", auth.object))
+		err = errgo.Newf("not found: %q", auth.object)
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusNotFound, err)
 		return
 	}
+	err = auth.checkContentType(contentType)
+	if err != nil {
+		s.metrics.authFailure(authFailureContentType)
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusForbidden, err)
+		return
+	}
+	// Opening the contents with the object key is the last check of a
+	// macaroon which carries one.
+	if auth.objectKey != nil {
+		contents, err = openObject(auth.objectKey, auth.object, contents)
+		if err != nil {
+			err = errgo.Newf("cannot decrypt %q", auth.object)
+			s.recordAudit(rec, err)
+			httpErrorf(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	s.recordAudit(rec, nil)
 
 	w.Header().Set("Content-Type", contentType)
-	_, err = w.Write(contents)
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	n, err := w.Write(contents)
+	s.metrics.served(n)
 	if err != nil {
-		log.Println("failed to write contents in response: %v", err)
+		log.Printf("failed to write contents in response: %v", err)
 		return
 	}
 }
 
+// getContents returns the contents of object id, along with the encoding
+// they are in. If the storage keeps the contents encoded and the client
+// accepts that encoding, they are returned as they are stored.
+func (s *Service) getContents(w http.ResponseWriter, r *http.Request, id string) ([]byte, string, string, error) {
+	if encStore, ok := s.store.(EncodedGetter); ok {
+		w.Header().Add("Vary", "Accept-Encoding")
+		contents, contentType, encoding, err := encStore.GetEncoded(id)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if encoding == "" || acceptsEncoding(r, encoding) {
+			return contents, contentType, encoding, nil
+		}
+	}
+	contents, contentType, err := s.store.Get(id)
+	return contents, contentType, "", err
+}
+
+// acceptsEncoding returns whether the request's Accept-Encoding header
+// allows a response in the given content encoding. An encoding named
+// explicitly takes precedence over a "*".
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	var acceptedAny bool
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(field, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding != encoding && coding != "*" {
+			continue
+		}
+		ok := true
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		if coding == encoding {
+			return ok
+		}
+		acceptedAny = ok
+	}
+	return acceptedAny
+}
+
 // del handles the request to delete content.
 func (s *Service) del(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	auth, err := s.checkRequest(requestInfo{request: r, params: p, operation: "delete"})
+	rec := s.newAuditRecord(r, "delete", p.ByName("object"))
+	auth, err := s.checkRequest(requestInfo{request: r, params: p, operation: "delete", audit: rec})
 	if err != nil {
-		httpErrorf(w, http.StatusForbidden, err)
+		s.recordAudit(rec, err)
+		authErrorf(w, err)
 		return
 	}
 
 	err = s.store.Delete(auth.object)
 	if err == ErrNotFound {
-		httpErrorf(w, http.StatusNotFound, errgo.Newf("not found: %q", auth.object))
+		err = errgo.Newf("not found: %q", auth.object)
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusNotFound, err)
 		return
 	} else if err != nil {
-		httpErrorf(w, http.StatusInternalServerError, errgo.Notef(err, "failed to delete %q: %v", auth.object))
+		err = errgo.Notef(err, "failed to delete %q", auth.object)
+		s.recordAudit(rec, err)
+		httpErrorf(w, http.StatusInternalServerError, err)
 		return
 	}
+	s.recordAudit(rec, nil)
+	if s.collections != nil {
+		// Memberships left behind are removed by garbage collection.
+		err = s.collections.RemoveObject(auth.object)
+		if err != nil {
+			log.Printf("failed to remove %q from collections: %v", auth.object, err)
+		}
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func newCheckers(info requestInfo) checkers.Checker {
-	return checkers.New(
+// Caveat conditions checked by oostore itself, in addition to those provided
+// by the macaroon-bakery.
+const (
+	condObject     = "object"
+	condOperation  = "operation"
+	condCollection = "collection"
+	condTimeAfter  = "time-after"
+)
+
+func (s *Service) newCheckers(info requestInfo) checkers.Checker {
+	cs := []checkers.Checker{
 		checkers.TimeBefore,
-		httpbakery.Checkers(info.request),
+		timeAfterChecker,
+		timeWindowChecker,
+		s.clientIPCIDRChecker(info.request),
+		clientCertChecker(info.request),
+		holderKeyChecker(info.request, info.holderSigs),
+		requestCheckers(info.request),
+		httpbakery.Checkers(s.clientRequest(info.request)),
 		operationChecker(info.operation),
 		requestObjectChecker(info.request, info.params),
-	)
+		objectKeyChecker(),
+		contentTypeChecker(),
+		rateLimitChecker(info.rateLimit),
+	}
+	if s.collections != nil {
+		cs = append(cs, collectionChecker(s.collections, info))
+	}
+	return checkers.New(cs...)
 }
 
 func requestObjectChecker(r *http.Request, p httprouter.Params) checkers.Checker {
 	return checkers.CheckerFunc{
-		Condition_: "object",
+		Condition_: condObject,
 		Check_: func(_, cav string) error {
 			if cav != p.ByName("object") {
 				return errgo.New("request does not match")
@@ -254,9 +744,26 @@ func requestObjectChecker(r *http.Request, p httprouter.Params) checkers.Checker
 	}
 }
 
+// timeAfterChecker checks that the current time on the server is not before
+// the time given in a time-after caveat, so that a macaroon can be shared
+// before the object it authorizes is to be released.
+var timeAfterChecker = checkers.CheckerFunc{
+	Condition_: condTimeAfter,
+	Check_: func(_, cav string) error {
+		t, err := time.Parse(time.RFC3339, cav)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if time.Now().Before(t) {
+			return fmt.Errorf("macaroon is not valid until %s", cav)
+		}
+		return nil
+	},
+}
+
 func operationChecker(op string) checkers.Checker {
 	return checkers.CheckerFunc{
-		Condition_: "operation",
+		Condition_: condOperation,
 		Check_: func(_, cav string) error {
 			allowedOps := strings.Split(cav, ",")
 			for _, allowedOp := range allowedOps {
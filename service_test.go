@@ -18,16 +18,26 @@ package oostore_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
 	"gopkg.in/macaroon.v1"
 
 	"github.com/cmars/oostore"
@@ -44,11 +54,16 @@ type serviceSuite struct {
 var _ = gc.Suite(&serviceSuite{})
 
 func (s *serviceSuite) SetUpTest(c *gc.C) {
+	s.setUpService(c, oostore.ServiceConfig{ObjectStore: oostore.NewMemStorage()})
+}
+
+func (s *serviceSuite) setUpService(c *gc.C, config oostore.ServiceConfig) {
 	var err error
-	s.store = oostore.NewMemStorage()
-	s.service, err = oostore.NewService(oostore.ServiceConfig{
-		ObjectStore: s.store,
-	})
+	s.store = config.ObjectStore
+	if config.CollectionStore == nil {
+		config.CollectionStore = oostore.NewMemCollectionStorage()
+	}
+	s.service, err = oostore.NewService(config)
 	c.Assert(err, gc.IsNil)
 	s.server = httptest.NewServer(s.service)
 }
@@ -195,6 +210,74 @@ func (s *serviceSuite) TestTimeBefore(c *gc.C) {
 	}
 }
 
+func (s *serviceSuite) TestTimeAfter(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	loc := resp.Header.Get("Location")
+	c.Assert(loc, gc.Not(gc.Equals), "", gc.Commentf("empty location"))
+
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for _, testCase := range []struct {
+		t          time.Time
+		statusCode int
+	}{{
+		time.Now().UTC().Add(-time.Hour),
+		http.StatusOK,
+	}, {
+		time.Now().UTC().Add(time.Hour),
+		http.StatusForbidden,
+	}} {
+		mjsonCav := withCaveat(c, mjson.Bytes(), fmt.Sprintf("time-after %s", testCase.t.Format(time.RFC3339)))
+		resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(mjsonCav))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode,
+			gc.Commentf("time-after %v at %v", testCase.t, time.Now().UTC()))
+	}
+}
+
+func (s *serviceSuite) TestTimeWindow(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	loc := resp.Header.Get("Location")
+	c.Assert(loc, gc.Not(gc.Equals), "", gc.Commentf("empty location"))
+
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	// A window from two to three hours from now, every day, does not
+	// contain the current time whichever day it is.
+	later := time.Now().UTC().Add(2 * time.Hour)
+	for i, testCase := range []struct {
+		window     string
+		statusCode int
+	}{{
+		"Sun-Sat 00:00-24:00",
+		http.StatusOK,
+	}, {
+		fmt.Sprintf("Sun-Sat %s-%s UTC", later.Format("15:04"), later.Add(time.Hour).Format("15:04")),
+		http.StatusForbidden,
+	}} {
+		mjsonCav := withCaveat(c, mjson.Bytes(), "time-window "+testCase.window)
+		resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(mjsonCav))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, gc.Commentf("test#%d: %s", i, testCase.window))
+	}
+}
+
 func (s *serviceSuite) TestClientIPAddr(c *gc.C) {
 	cl := &http.Client{}
 	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
@@ -242,6 +325,389 @@ func (s *serviceSuite) TestClientIPAddr(c *gc.C) {
 	}
 }
 
+func (s *serviceSuite) TestClientIPCIDR(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	loc := resp.Header.Get("Location")
+	c.Assert(loc, gc.Not(gc.Equals), "", gc.Commentf("empty location"))
+
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for _, testCase := range []struct {
+		cidrs        string
+		forwardedFor string
+		statusCode   int
+	}{{
+		cidrs:      "127.0.0.0/8",
+		statusCode: http.StatusOK,
+	}, {
+		cidrs:      "10.0.0.0/8, 127.0.0.1/32",
+		statusCode: http.StatusOK,
+	}, {
+		cidrs:      "10.0.0.0/8,::1/128",
+		statusCode: http.StatusForbidden,
+	}, {
+		// Forwarded addresses are ignored without trusted proxies.
+		cidrs:        "10.0.0.0/8",
+		forwardedFor: "10.1.2.3",
+		statusCode:   http.StatusForbidden,
+	}, {
+		cidrs:      "bad-network",
+		statusCode: http.StatusForbidden,
+	}} {
+		req, err := http.NewRequest("POST", s.server.URL+loc,
+			bytes.NewBuffer(withCaveat(c, mjson.Bytes(), "client-ip-cidr "+testCase.cidrs)))
+		c.Assert(err, gc.IsNil)
+		if testCase.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+		}
+		resp, err = cl.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode,
+			gc.Commentf("client-ip-cidr %s", testCase.cidrs))
+	}
+}
+
+func (s *serviceSuite) TestContentType(c *gc.C) {
+	cl := &http.Client{}
+	objects := make(map[string]string)
+	auths := make(map[string][]byte)
+	for _, contentType := range []string{"image/png", "text/plain; charset=utf-8"} {
+		resp, err := cl.Post(s.server.URL, contentType, bytes.NewBufferString("hunter2"))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		objects[contentType] = resp.Header.Get("Location")
+		auths[contentType], err = ioutil.ReadAll(resp.Body)
+		c.Assert(err, gc.IsNil)
+	}
+
+	for i, testCase := range []struct {
+		contentType string
+		caveats     []string
+		discharge   string
+		statusCode  int
+	}{{
+		contentType: "image/png",
+		caveats:     []string{"content-type image/*"},
+		statusCode:  http.StatusOK,
+	}, {
+		contentType: "image/png",
+		discharge:   "content-type image/*",
+		statusCode:  http.StatusOK,
+	}, {
+		contentType: "image/png",
+		discharge:   "content-type text/*",
+		statusCode:  http.StatusForbidden,
+	}, {
+		contentType: "image/png",
+		caveats:     []string{"content-type image/*"},
+		discharge:   "content-type image/jpeg",
+		statusCode:  http.StatusForbidden,
+	}, {
+		contentType: "image/png",
+		caveats:     []string{"content-type IMAGE/PNG"},
+		statusCode:  http.StatusOK,
+	}, {
+		contentType: "image/png",
+		caveats:     []string{"content-type text/*, image/png"},
+		statusCode:  http.StatusOK,
+	}, {
+		contentType: "image/png",
+		caveats:     []string{"content-type */*"},
+		statusCode:  http.StatusOK,
+	}, {
+		contentType: "image/png",
+		caveats:     []string{"content-type text/*"},
+		statusCode:  http.StatusForbidden,
+	}, {
+		contentType: "image/png",
+		caveats:     []string{"content-type image/*", "content-type image/jpeg"},
+		statusCode:  http.StatusForbidden,
+	}, {
+		contentType: "text/plain; charset=utf-8",
+		caveats:     []string{"content-type text/plain"},
+		statusCode:  http.StatusOK,
+	}, {
+		contentType: "text/plain; charset=utf-8",
+		caveats:     []string{"content-type image/*"},
+		statusCode:  http.StatusForbidden,
+	}} {
+		comment := gc.Commentf("test#%d: %s %v %q", i, testCase.contentType, testCase.caveats, testCase.discharge)
+		auth := auths[testCase.contentType]
+		for _, cav := range testCase.caveats {
+			auth = withCaveat(c, auth, cav)
+		}
+		if testCase.discharge != "" {
+			auth = withDischargeCaveat(c, auth, testCase.discharge)
+		}
+		resp, err := cl.Post(s.server.URL+objects[testCase.contentType], "application/json", bytes.NewBuffer(auth))
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, gc.IsNil, comment)
+		if testCase.statusCode == http.StatusOK {
+			c.Assert(string(body), gc.Equals, "hunter2", comment)
+			c.Assert(resp.Header.Get("Content-Type"), gc.Equals, testCase.contentType, comment)
+		} else {
+			c.Assert(string(body), gc.Not(gc.Matches), ".*hunter2.*", comment)
+		}
+	}
+}
+
+func (s *serviceSuite) TestHolderKey(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	bound := withCaveat(c, auth, oostore.HolderKeyCaveat(pub))
+	var ms, unbound macaroon.Slice
+	c.Assert(json.Unmarshal(bound, &ms), gc.IsNil)
+	c.Assert(json.Unmarshal(auth, &unbound), gc.IsNil)
+
+	for i, testCase := range []struct {
+		desc       string
+		sign       func(req *http.Request)
+		statusCode int
+	}{{
+		desc:       "unsigned",
+		sign:       func(req *http.Request) {},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed by holder",
+		sign: func(req *http.Request) {
+			c.Assert(oostore.SignRequest(req, ms[0], key), gc.IsNil)
+		},
+		statusCode: http.StatusOK,
+	}, {
+		desc: "signed by holder among others",
+		sign: func(req *http.Request) {
+			c.Assert(oostore.SignRequest(req, ms[0], otherKey), gc.IsNil)
+			c.Assert(oostore.SignRequest(req, ms[0], key), gc.IsNil)
+		},
+		statusCode: http.StatusOK,
+	}, {
+		desc: "signed by another key",
+		sign: func(req *http.Request) {
+			c.Assert(oostore.SignRequest(req, ms[0], otherKey), gc.IsNil)
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed for another macaroon",
+		sign: func(req *http.Request) {
+			c.Assert(oostore.SignRequest(req, unbound[0], key), gc.IsNil)
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed for another request",
+		sign: func(req *http.Request) {
+			del, err := http.NewRequest("DELETE", req.URL.String(), bytes.NewBuffer(bound))
+			c.Assert(err, gc.IsNil)
+			c.Assert(oostore.SignRequest(del, ms[0], key), gc.IsNil)
+			req.Header.Set(oostore.HolderSignatureHeader, del.Header.Get(oostore.HolderSignatureHeader))
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed for another query",
+		sign: func(req *http.Request) {
+			other, err := http.NewRequest("POST", req.URL.String()+"?limit=1", bytes.NewBuffer(bound))
+			c.Assert(err, gc.IsNil)
+			c.Assert(oostore.SignRequest(other, ms[0], key), gc.IsNil)
+			req.Header.Set(oostore.HolderSignatureHeader, other.Header.Get(oostore.HolderSignatureHeader))
+			req.URL.RawQuery = "limit=2"
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed for another host",
+		sign: func(req *http.Request) {
+			other, err := http.NewRequest("POST", req.URL.String(), bytes.NewBuffer(bound))
+			c.Assert(err, gc.IsNil)
+			other.Host = "other.example.com"
+			c.Assert(oostore.SignRequest(other, ms[0], key), gc.IsNil)
+			req.Header.Set(oostore.HolderSignatureHeader, other.Header.Get(oostore.HolderSignatureHeader))
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed with the query",
+		sign: func(req *http.Request) {
+			req.URL.RawQuery = "limit=1"
+			c.Assert(oostore.SignRequest(req, ms[0], key), gc.IsNil)
+		},
+		statusCode: http.StatusOK,
+	}, {
+		desc: "signed for another body",
+		sign: func(req *http.Request) {
+			other, err := http.NewRequest("POST", req.URL.String(), bytes.NewBufferString("[]"))
+			c.Assert(err, gc.IsNil)
+			c.Assert(oostore.SignRequest(other, ms[0], key), gc.IsNil)
+			req.Header.Set(oostore.HolderSignatureHeader, other.Header.Get(oostore.HolderSignatureHeader))
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed just now",
+		sign: func(req *http.Request) {
+			signHolderRequest(c, req, bound, ms[0], key, time.Now().Add(-time.Minute))
+		},
+		statusCode: http.StatusOK,
+	}, {
+		desc: "signature expired",
+		sign: func(req *http.Request) {
+			signHolderRequest(c, req, bound, ms[0], key, time.Now().Add(-10*time.Minute))
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "signed in the future",
+		sign: func(req *http.Request) {
+			signHolderRequest(c, req, bound, ms[0], key, time.Now().Add(10*time.Minute))
+		},
+		statusCode: http.StatusForbidden,
+	}, {
+		desc: "bad signature",
+		sign: func(req *http.Request) {
+			req.Header.Set(oostore.HolderSignatureHeader, time.Now().UTC().Format(time.RFC3339)+" bm9uY2U bm90IGEgc2lnbmF0dXJl")
+		},
+		statusCode: http.StatusForbidden,
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.desc)
+		req, err := http.NewRequest("POST", s.server.URL+loc, bytes.NewBuffer(bound))
+		c.Assert(err, gc.IsNil, comment)
+		testCase.sign(req)
+		resp, err := cl.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+	}
+
+	// Each signature is accepted only once, however it is encoded.
+	req, err := http.NewRequest("POST", s.server.URL+loc, bytes.NewBuffer(bound))
+	c.Assert(err, gc.IsNil)
+	c.Assert(oostore.SignRequest(req, ms[0], key), gc.IsNil)
+	header := req.Header.Get(oostore.HolderSignatureHeader)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	for i, replayed := range []string{header, strings.Replace(header, " ", "  ", -1)} {
+		comment := gc.Commentf("replay#%d", i)
+		req, err = http.NewRequest("POST", s.server.URL+loc, bytes.NewBuffer(bound))
+		c.Assert(err, gc.IsNil, comment)
+		req.Header.Set(oostore.HolderSignatureHeader, replayed)
+		resp, err = cl.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden, comment)
+	}
+}
+
+// signHolderRequest signs req, with the given body, for macaroon m bound to
+// key, as though it were signed at time t.
+func signHolderRequest(c *gc.C, req *http.Request, body []byte, m *macaroon.Macaroon, key ed25519.PrivateKey, t time.Time) {
+	ts := t.UTC().Format(time.RFC3339)
+	digest := sha256.Sum256(body)
+	msg := strings.Join([]string{
+		"oostore-holder-signature",
+		req.Method,
+		req.URL.Host,
+		req.URL.RequestURI(),
+		ts,
+		"nonce",
+		hex.EncodeToString(m.Signature()),
+		hex.EncodeToString(digest[:]),
+	}, "\n")
+	sig := ed25519.Sign(key, []byte(msg))
+	req.Header.Add(oostore.HolderSignatureHeader, ts+" nonce "+base64.StdEncoding.EncodeToString(sig))
+}
+
+func (s *serviceSuite) TestRequestCaveats(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	loc := resp.Header.Get("Location")
+	auth, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for i, testCase := range []struct {
+		caveat     string
+		header     http.Header
+		statusCode int
+	}{{
+		caveat:     "origin https://app.example.com",
+		header:     http.Header{"Origin": {"https://app.example.com"}},
+		statusCode: http.StatusOK,
+	}, {
+		caveat:     "origin https://app.example.com",
+		header:     http.Header{"Origin": {"https://APP.example.com"}},
+		statusCode: http.StatusOK,
+	}, {
+		caveat:     "origin https://other.example.com, https://app.example.com",
+		header:     http.Header{"Origin": {"https://app.example.com"}},
+		statusCode: http.StatusOK,
+	}, {
+		caveat:     "origin https://app.example.com",
+		header:     http.Header{"Origin": {"https://app.example.com.evil.com"}},
+		statusCode: http.StatusForbidden,
+	}, {
+		caveat:     "origin https://app.example.com",
+		statusCode: http.StatusForbidden,
+	}, {
+		caveat:     "referer-prefix https://app.example.com/docs/",
+		header:     http.Header{"Referer": {"https://app.example.com/docs/42"}},
+		statusCode: http.StatusOK,
+	}, {
+		caveat:     "referer-prefix https://app.example.com/docs/",
+		header:     http.Header{"Referer": {"https://app.example.com/admin"}},
+		statusCode: http.StatusForbidden,
+	}, {
+		caveat:     "referer-prefix https://app.example.com/docs/",
+		statusCode: http.StatusForbidden,
+	}, {
+		caveat:     "header X-Tenant=acme",
+		header:     http.Header{"X-Tenant": {"acme"}},
+		statusCode: http.StatusOK,
+	}, {
+		caveat:     "header x-tenant=acme corp",
+		header:     http.Header{"X-Tenant": {"acme corp"}},
+		statusCode: http.StatusOK,
+	}, {
+		caveat:     "header X-Tenant=acme",
+		header:     http.Header{"X-Tenant": {"acme2"}},
+		statusCode: http.StatusForbidden,
+	}, {
+		caveat:     "header X-Tenant=acme",
+		statusCode: http.StatusForbidden,
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.caveat)
+		req, err := http.NewRequest("POST", s.server.URL+loc, bytes.NewBuffer(withCaveat(c, auth, testCase.caveat)))
+		c.Assert(err, gc.IsNil, comment)
+		for k, v := range testCase.header {
+			req.Header[k] = v
+		}
+		resp, err := cl.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+	}
+}
+
 func (s *serviceSuite) TestOperationFetchOnly(c *gc.C) {
 	cl := &http.Client{}
 	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
@@ -306,6 +772,618 @@ func (s *serviceSuite) TestOperationFetchOnly(c *gc.C) {
 	}
 }
 
+func (s *serviceSuite) TestAttenuate(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	loc := resp.Header.Get("Location")
+	c.Assert(loc, gc.Not(gc.Equals), "", gc.Commentf("empty location"))
+
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	for i, testCase := range []struct {
+		desc    string
+		caveats []string
+	}{{
+		desc:    "unknown condition",
+		caveats: []string{"operation fetch", "frobnicate now"},
+	}, {
+		desc:    "bad timestamp",
+		caveats: []string{"time-before tomorrow"},
+	}, {
+		desc:    "bad time window",
+		caveats: []string{"time-window weekdays 09:00-17:00"},
+	}, {
+		desc:    "bad embargo timestamp",
+		caveats: []string{"time-after tomorrow"},
+	}, {
+		desc:    "bad address",
+		caveats: []string{"client-ip-addr bad-address"},
+	}, {
+		desc:    "bad network",
+		caveats: []string{"client-ip-cidr 10.0.0.0/8,10.0.0.1"},
+	}, {
+		desc:    "bad fingerprint",
+		caveats: []string{"client-cert-sha256 0123456789abcdef"},
+	}, {
+		desc:    "bad holder key",
+		caveats: []string{"holder-key bm90IGEga2V5"},
+	}, {
+		desc:    "bad origin",
+		caveats: []string{"origin app.example.com"},
+	}, {
+		desc:    "referer prefix without path",
+		caveats: []string{"referer-prefix https://app.example.com"},
+	}, {
+		desc:    "bad header",
+		caveats: []string{"header X-Tenant"},
+	}, {
+		desc:    "bad media range",
+		caveats: []string{"content-type image"},
+	}, {
+		desc:    "wildcard type with subtype",
+		caveats: []string{"content-type */png"},
+	}, {
+		desc:    "unknown operation",
+		caveats: []string{"operation fetch,frobnicate"},
+	}, {
+		desc:    "bad rate limit",
+		caveats: []string{"rate-limit 0/1h"},
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.desc)
+		resp := s.attenuate(c, mjson.Bytes(), testCase.caveats...)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest, comment)
+	}
+
+	resp = s.attenuate(c, mjson.Bytes(),
+		"operation fetch", fmt.Sprintf("time-before %s", time.Now().UTC().Add(time.Hour).Format(time.RFC3339)))
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var mjsonFetch bytes.Buffer
+	_, err = io.Copy(&mjsonFetch, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	var ms macaroon.Slice
+	err = json.NewDecoder(bytes.NewBuffer(mjsonFetch.Bytes())).Decode(&ms)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms, gc.HasLen, 1)
+	c.Assert(ms[0].Caveats(), gc.HasLen, 3)
+
+	req, err := http.NewRequest("DELETE", s.server.URL+loc, bytes.NewBuffer(mjsonFetch.Bytes()))
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+
+	resp, err = cl.Post(s.server.URL+loc, "application/json", bytes.NewBuffer(mjsonFetch.Bytes()))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *serviceSuite) TestInspect(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	loc := resp.Header.Get("Location")
+	c.Assert(loc, gc.Not(gc.Equals), "", gc.Commentf("empty location"))
+
+	var mjson bytes.Buffer
+	_, err = io.Copy(&mjson, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	expires := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	mjsonFetch := withCaveat(c, mjson.Bytes(), "operation fetch,delete")
+	mjsonFetch = withCaveat(c, mjsonFetch, "operation fetch")
+	mjsonFetch = withCaveat(c, mjsonFetch, "client-ip-addr 127.0.0.1")
+	mjsonFetch = withCaveat(c, mjsonFetch, fmt.Sprintf("time-before %s", expires.Format(time.RFC3339)))
+	mjsonExpired := withCaveat(c, mjson.Bytes(),
+		fmt.Sprintf("time-before %s", time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)))
+	notBefore := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	mjsonEmbargoed := withCaveat(c, mjson.Bytes(), fmt.Sprintf("time-after %s", notBefore.Format(time.RFC3339)))
+
+	for i, testCase := range []struct {
+		desc       string
+		auth       []byte
+		operations []string
+		verified   map[string]bool
+	}{{
+		desc:       "unrestricted",
+		auth:       mjson.Bytes(),
+		operations: []string{"add", "create", "delete", "fetch", "inventory", "list"},
+		verified:   verified("fetch", "delete"),
+	}, {
+		desc:       "fetch only",
+		auth:       mjsonFetch,
+		operations: []string{"fetch"},
+		verified:   verified("fetch"),
+	}, {
+		desc:       "expired",
+		auth:       mjsonExpired,
+		operations: []string{"add", "create", "delete", "fetch", "inventory", "list"},
+		verified:   verified(),
+	}, {
+		desc:       "embargoed",
+		auth:       mjsonEmbargoed,
+		operations: []string{"add", "create", "delete", "fetch", "inventory", "list"},
+		verified:   verified(),
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.desc)
+		resp, err := cl.Post(s.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(testCase.auth))
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, comment)
+
+		var insp oostore.Inspection
+		err = json.NewDecoder(resp.Body).Decode(&insp)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(insp.Object, gc.Equals, path.Base(loc), comment)
+		c.Assert(insp.Operations, gc.DeepEquals, testCase.operations, comment)
+		c.Assert(insp.Verified, gc.DeepEquals, testCase.verified, comment)
+	}
+
+	resp, err = cl.Post(s.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(mjsonFetch))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	var insp oostore.Inspection
+	err = json.NewDecoder(resp.Body).Decode(&insp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(insp.Expires, gc.NotNil)
+	c.Assert(insp.Expires.Equal(expires), gc.Equals, true)
+	c.Assert(insp.ClientIPAddrs, gc.DeepEquals, []string{"127.0.0.1"})
+	c.Assert(insp.NotBefore, gc.IsNil)
+	c.Assert(insp.Caveats, gc.HasLen, 5)
+
+	resp, err = cl.Post(s.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(mjsonEmbargoed))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	insp = oostore.Inspection{}
+	err = json.NewDecoder(resp.Body).Decode(&insp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(insp.NotBefore, gc.NotNil)
+	c.Assert(insp.NotBefore.Equal(notBefore), gc.Equals, true)
+	c.Assert(insp.Errors["fetch"], gc.Matches, ".*macaroon is not valid until .*")
+
+	// Every kind of restriction is reported.
+	mjsonRestricted := mjson.Bytes()
+	for _, cav := range []string{
+		"time-window Mon-Fri 09:00-17:00 UTC",
+		"rate-limit 10/1m",
+		"rate-limit 100/1h",
+		"origin https://app.example.com",
+		"referer-prefix https://app.example.com/docs/",
+		"header X-Tenant=acme",
+	} {
+		mjsonRestricted = withCaveat(c, mjsonRestricted, cav)
+	}
+	resp, err = cl.Post(s.server.URL+"/_/inspect", "application/json", bytes.NewBuffer(mjsonRestricted))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	insp = oostore.Inspection{}
+	err = json.NewDecoder(resp.Body).Decode(&insp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(insp.TimeWindows, gc.DeepEquals, []string{"Mon-Fri 09:00-17:00 UTC"})
+	c.Assert(insp.RateLimits, gc.DeepEquals, []string{"10/1m", "100/1h"})
+	c.Assert(insp.Origins, gc.DeepEquals, []string{"https://app.example.com"})
+	c.Assert(insp.RefererPrefixes, gc.DeepEquals, []string{"https://app.example.com/docs/"})
+	c.Assert(insp.Headers, gc.DeepEquals, []string{"X-Tenant=acme"})
+	c.Assert(insp.Caveats, gc.HasLen, 7)
+}
+
+func (s *serviceSuite) TestCollection(c *gc.C) {
+	cl := &http.Client{}
+	objects := make(map[string]string)
+	auths := make(map[string][]byte)
+	for _, contents := range []string{"a", "b", "x"} {
+		resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString(contents))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		objects[contents] = resp.Header.Get("Location")
+		var mjson bytes.Buffer
+		_, err = io.Copy(&mjson, resp.Body)
+		c.Assert(err, gc.IsNil)
+		auths[contents] = mjson.Bytes()
+	}
+
+	resp, err := cl.Post(s.server.URL+"/_/collection", "application/json", bytes.NewBuffer(nil))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	collLoc := resp.Header.Get("Location")
+	c.Assert(collLoc, gc.Not(gc.Equals), "", gc.Commentf("empty location"))
+	var collAuth bytes.Buffer
+	_, err = io.Copy(&collAuth, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	addReq := func(collAuth, objectAuth []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(map[string]json.RawMessage{
+			"collection": collAuth,
+			"object":     objectAuth,
+		})
+		c.Assert(err, gc.IsNil)
+		return &buf
+	}
+	for i, testCase := range []struct {
+		desc       string
+		object     string
+		collAuth   []byte
+		objectAuth []byte
+		statusCode int
+	}{{
+		desc:       "object macaroon can't stand in for collection",
+		object:     "a",
+		collAuth:   auths["a"],
+		objectAuth: auths["a"],
+		statusCode: http.StatusForbidden,
+	}, {
+		desc:       "must be authorized for the object",
+		object:     "a",
+		collAuth:   collAuth.Bytes(),
+		objectAuth: auths["b"],
+		statusCode: http.StatusForbidden,
+	}, {
+		desc:       "add a",
+		object:     "a",
+		collAuth:   collAuth.Bytes(),
+		objectAuth: auths["a"],
+		statusCode: http.StatusNoContent,
+	}, {
+		desc:       "add b, fetch-only",
+		object:     "b",
+		collAuth:   collAuth.Bytes(),
+		objectAuth: withCaveat(c, auths["b"], "operation fetch"),
+		statusCode: http.StatusNoContent,
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.desc)
+		req, err := http.NewRequest("PUT", s.server.URL+collLoc+objects[testCase.object],
+			addReq(testCase.collAuth, testCase.objectAuth))
+		c.Assert(err, gc.IsNil, comment)
+		resp, err := cl.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+	}
+
+	resp, err = cl.Post(s.server.URL+collLoc, "application/json", bytes.NewBuffer(collAuth.Bytes()))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var members struct {
+		Members []string `json:"members"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&members)
+	c.Assert(err, gc.IsNil)
+	c.Assert(members.Members, gc.HasLen, 2)
+	for _, id := range members.Members {
+		c.Assert("/"+id == objects["a"] || "/"+id == objects["b"], gc.Equals, true)
+	}
+
+	resp, err = cl.Post(s.server.URL+collLoc, "application/json", bytes.NewBuffer(auths["a"]))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+
+	for i, testCase := range []struct {
+		object     string
+		method     string
+		statusCode int
+		contents   string
+	}{
+		{"a", "POST", http.StatusOK, "a"},
+		{"b", "POST", http.StatusOK, "b"},
+		{"x", "POST", http.StatusForbidden, ""},
+		{"a", "DELETE", http.StatusForbidden, ""},
+	} {
+		comment := gc.Commentf("test#%d: %s %s", i, testCase.method, testCase.object)
+		req, err := http.NewRequest(testCase.method, s.server.URL+objects[testCase.object],
+			bytes.NewBuffer(collAuth.Bytes()))
+		c.Assert(err, gc.IsNil, comment)
+		resp, err := cl.Do(req)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, testCase.statusCode, comment)
+		if testCase.contents != "" {
+			var contents bytes.Buffer
+			_, err = io.Copy(&contents, resp.Body)
+			c.Assert(err, gc.IsNil, comment)
+			c.Assert(contents.String(), gc.Equals, testCase.contents, comment)
+		}
+	}
+
+	// Deleted objects are removed from the collection.
+	req, err := http.NewRequest("DELETE", s.server.URL+objects["a"], bytes.NewBuffer(auths["a"]))
+	c.Assert(err, gc.IsNil)
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent)
+	resp, err = cl.Post(s.server.URL+collLoc, "application/json", bytes.NewBuffer(collAuth.Bytes()))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	members.Members = nil
+	err = json.NewDecoder(resp.Body).Decode(&members)
+	c.Assert(err, gc.IsNil)
+	c.Assert(members.Members, gc.HasLen, 1)
+	c.Assert("/"+members.Members[0], gc.Equals, objects["b"])
+}
+
+func (s *serviceSuite) TestOwnerInventory(c *gc.C) {
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL+"/_/owner", "application/json", bytes.NewBuffer(nil))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	var ownerAuth bytes.Buffer
+	_, err = io.Copy(&ownerAuth, resp.Body)
+	c.Assert(err, gc.IsNil)
+
+	var objects []string
+	var objectAuth []byte
+	for _, contents := range []string{"a", "bb", "ccc", "unowned"} {
+		req, err := http.NewRequest("POST", s.server.URL, bytes.NewBufferString(contents))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "something/something")
+		if contents != "unowned" {
+			req.Header.Set("Oostore-Owner", base64.StdEncoding.EncodeToString(ownerAuth.Bytes()))
+		}
+		resp, err := cl.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		if contents != "unowned" {
+			objects = append(objects, path.Base(resp.Header.Get("Location")))
+		} else {
+			var mjson bytes.Buffer
+			_, err = io.Copy(&mjson, resp.Body)
+			c.Assert(err, gc.IsNil)
+			objectAuth = mjson.Bytes()
+		}
+	}
+	sort.Strings(objects)
+
+	req, err := http.NewRequest("POST", s.server.URL, bytes.NewBufferString("nope"))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Oostore-Owner", base64.StdEncoding.EncodeToString(objectAuth))
+	resp, err = cl.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+
+	var listed []oostore.ObjectInfo
+	after := ""
+	for i := 0; i < 2; i++ {
+		resp, err = cl.Post(s.server.URL+"/_/owner/objects?limit=2&after="+url.QueryEscape(after),
+			"application/json", bytes.NewBuffer(ownerAuth.Bytes()))
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+		var page struct {
+			Objects []oostore.ObjectInfo `json:"objects"`
+			Next    string               `json:"next"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		c.Assert(err, gc.IsNil)
+		listed = append(listed, page.Objects...)
+		after = page.Next
+	}
+	c.Assert(after, gc.Equals, "")
+	c.Assert(listed, gc.HasLen, 3)
+	for i, info := range listed {
+		c.Assert(info.ID, gc.Equals, objects[i])
+		c.Assert(info.ContentType, gc.Equals, "something/something")
+		c.Assert(info.Created.IsZero(), gc.Equals, false)
+	}
+
+	// Owner and object macaroons can't stand in for each other.
+	resp, err = cl.Post(s.server.URL+"/_/owner/objects", "application/json", bytes.NewBuffer(objectAuth))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+	resp, err = cl.Post(s.server.URL+"/"+objects[0], "application/json", bytes.NewBuffer(ownerAuth.Bytes()))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusForbidden)
+}
+
+type failingStorage struct {
+	oostore.Storage
+}
+
+func (failingStorage) PutOwned(id string, contents []byte, contentType string, owner string) error {
+	return fmt.Errorf("no space left on device")
+}
+
+func (s *serviceSuite) TestObjectMacaroonID(c *gc.C) {
+	s.TearDownTest(c)
+	bakeryStore := bakery.NewMemStorage()
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+		BakeryStore: bakeryStore,
+	})
+	cl := &http.Client{}
+	resp, err := cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	id := path.Base(resp.Header.Get("Location"))
+	var ms macaroon.Slice
+	c.Assert(json.NewDecoder(resp.Body).Decode(&ms), gc.IsNil)
+	c.Assert(ms[0].Id(), gc.Equals, oostore.ObjectMacaroonID(id))
+	_, err = bakeryStore.Get(oostore.ObjectMacaroonID(id))
+	c.Assert(err, gc.IsNil)
+
+	// If the content can't be stored, its root key is removed.
+	s.TearDownTest(c)
+	recorder := &recordingBakeryStore{Storage: bakeryStore}
+	s.setUpService(c, oostore.ServiceConfig{
+		ObjectStore: failingStorage{oostore.NewMemStorage()},
+		BakeryStore: recorder,
+	})
+	resp, err = cl.Post(s.server.URL, "something/something", bytes.NewBufferString("hunter2"))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusInternalServerError)
+	c.Assert(resp.Header.Get("Location"), gc.Equals, "")
+	c.Assert(recorder.puts, gc.HasLen, 1)
+	c.Assert(recorder.dels, gc.DeepEquals, recorder.puts)
+}
+
+// recordingBakeryStore records the locations of bakery items stored and
+// deleted.
+type recordingBakeryStore struct {
+	bakery.Storage
+	puts, dels []string
+}
+
+func (s *recordingBakeryStore) Put(location, item string) error {
+	s.puts = append(s.puts, location)
+	return s.Storage.Put(location, item)
+}
+
+func (s *recordingBakeryStore) Del(location string) error {
+	s.dels = append(s.dels, location)
+	return s.Storage.Del(location)
+}
+
+// atomicStorage stages the root keys of new object macaroons, and keeps
+// them in bakeryStore only if the object is stored.
+type atomicStorage struct {
+	oostore.EncodedStorage
+	bakeryStore bakery.Storage
+	fail        bool
+	creates     int
+}
+
+func (s *atomicStorage) CreateObject(id string, contents []byte, contentType string, owner string, newMacaroon func(bakery.Storage) error) error {
+	return s.CreateEncodedObject(id, contents, contentType, "", owner, newMacaroon)
+}
+
+func (s *atomicStorage) CreateEncodedObject(id string, contents []byte, contentType string, encoding string, owner string, newMacaroon func(bakery.Storage) error) error {
+	s.creates++
+	staged := bakery.NewMemStorage()
+	err := newMacaroon(staged)
+	if err != nil {
+		return err
+	}
+	if s.fail {
+		return fmt.Errorf("rolled back")
+	}
+	item, err := staged.Get(oostore.ObjectMacaroonID(id))
+	if err != nil {
+		return err
+	}
+	err = s.PutEncoded(id, contents, contentType, encoding, owner)
+	if err != nil {
+		return err
+	}
+	return s.bakeryStore.Put(oostore.ObjectMacaroonID(id), item)
+}
+
+func (s *serviceSuite) TestAtomicCreate(c *gc.C) {
+	cl := &http.Client{}
+	for i, testCase := range []struct {
+		desc    string
+		fail    bool
+		wrap    func(oostore.Storage) oostore.Storage
+		creates int
+	}{{
+		desc:    "atomic storage",
+		wrap:    func(store oostore.Storage) oostore.Storage { return store },
+		creates: 1,
+	}, {
+		desc: "atomic storage, failing",
+		fail: true,
+		wrap: func(store oostore.Storage) oostore.Storage { return store },
+	}, {
+		desc: "wrapped atomic storage",
+		wrap: func(store oostore.Storage) oostore.Storage {
+			encrypted, err := oostore.NewEncryptedStorage(store, masterKey("one"))
+			c.Assert(err, gc.IsNil)
+			return oostore.NewCompressedStorage(encrypted, 0)
+		},
+		creates: 1,
+	}} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.desc)
+		s.TearDownTest(c)
+		bakeryStore := &recordingBakeryStore{Storage: bakery.NewMemStorage()}
+		store := &atomicStorage{
+			EncodedStorage: oostore.NewMemStorage(),
+			bakeryStore:    bakeryStore,
+			fail:           testCase.fail,
+		}
+		s.setUpService(c, oostore.ServiceConfig{
+			ObjectStore: testCase.wrap(store),
+			BakeryStore: bakeryStore,
+		})
+		resp, err := cl.Post(s.server.URL, "text/plain", bytes.NewBufferString("hunter2"))
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		if testCase.fail {
+			c.Assert(resp.StatusCode, gc.Equals, http.StatusInternalServerError, comment)
+			c.Assert(resp.Header.Get("Location"), gc.Equals, "", comment)
+			c.Assert(bakeryStore.puts, gc.HasLen, 0, comment)
+			continue
+		}
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, comment)
+		c.Assert(store.creates, gc.Equals, testCase.creates, comment)
+		c.Assert(bakeryStore.puts, gc.HasLen, 1, comment)
+		loc := resp.Header.Get("Location")
+		var mjson bytes.Buffer
+		_, err = io.Copy(&mjson, resp.Body)
+		c.Assert(err, gc.IsNil, comment)
+
+		resp, err = cl.Post(s.server.URL+loc, "application/json", &mjson)
+		c.Assert(err, gc.IsNil, comment)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, comment)
+		contents, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(string(contents), gc.Equals, "hunter2", comment)
+	}
+}
+
+// verified returns the inspection result expected when only the given
+// operations verify.
+func verified(ops ...string) map[string]bool {
+	result := map[string]bool{
+		"fetch": false, "delete": false, "list": false, "add": false, "create": false, "inventory": false,
+	}
+	for _, op := range ops {
+		result[op] = true
+	}
+	return result
+}
+
+// attenuate asks the service to add caveats to the JSON-encoded macaroon
+// slice in buf.
+func (s *serviceSuite) attenuate(c *gc.C, buf []byte, cavs ...string) *http.Response {
+	var ms macaroon.Slice
+	err := json.NewDecoder(bytes.NewBuffer(buf)).Decode(&ms)
+	c.Assert(err, gc.IsNil)
+	var reqjson bytes.Buffer
+	err = json.NewEncoder(&reqjson).Encode(map[string]interface{}{
+		"macaroons": ms,
+		"caveats":   cavs,
+	})
+	c.Assert(err, gc.IsNil)
+	resp, err := http.Post(s.server.URL+"/_/attenuate", "application/json", &reqjson)
+	c.Assert(err, gc.IsNil)
+	return resp
+}
+
 func withCaveat(c *gc.C, buf []byte, cav string) []byte {
 	var ms macaroon.Slice
 	var mjson bytes.Buffer
@@ -318,3 +1396,27 @@ func withCaveat(c *gc.C, buf []byte, cav string) []byte {
 	c.Assert(err, gc.IsNil)
 	return mjson.Bytes()
 }
+
+// withDischargeCaveat adds a third-party caveat to the macaroon in buf, and
+// returns it with a bound discharge macaroon carrying the first-party caveat
+// cav.
+func withDischargeCaveat(c *gc.C, buf []byte, cav string) []byte {
+	var ms macaroon.Slice
+	var mjson bytes.Buffer
+	err := json.NewDecoder(bytes.NewBuffer(buf)).Decode(&ms)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms, gc.HasLen, 1)
+	rootKey := make([]byte, 24)
+	_, err = rand.Read(rootKey)
+	c.Assert(err, gc.IsNil)
+	err = ms[0].AddThirdPartyCaveat(rootKey, "discharge-test", "https://third-party.example.com")
+	c.Assert(err, gc.IsNil)
+	d, err := macaroon.New(rootKey, "discharge-test", "https://third-party.example.com")
+	c.Assert(err, gc.IsNil)
+	err = d.AddFirstPartyCaveat(cav)
+	c.Assert(err, gc.IsNil)
+	d.Bind(ms[0].Signature())
+	err = json.NewEncoder(&mjson).Encode(append(ms, d))
+	c.Assert(err, gc.IsNil)
+	return mjson.Bytes()
+}
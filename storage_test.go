@@ -0,0 +1,53 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+	"github.com/cmars/oostore/storagetest"
+)
+
+// storageSuite runs the storage conformance tests against the in-memory
+// implementations and wrappers.
+type storageSuite struct {
+	storagetest.StorageSuite
+	newStorage func(c *gc.C) oostore.Storage
+}
+
+func (s *storageSuite) SetUpTest(c *gc.C) {
+	s.Storage = s.newStorage(c)
+}
+
+var _ = gc.Suite(&storageSuite{newStorage: func(c *gc.C) oostore.Storage {
+	return oostore.NewMemStorage()
+}})
+
+var _ = gc.Suite(&storageSuite{newStorage: func(c *gc.C) oostore.Storage {
+	return oostore.NewMemDedupStorage()
+}})
+
+var _ = gc.Suite(&storageSuite{newStorage: func(c *gc.C) oostore.Storage {
+	store, err := oostore.NewEncryptedStorage(oostore.NewMemStorage(), masterKey("one"))
+	c.Assert(err, gc.IsNil)
+	return store
+}})
+
+var _ = gc.Suite(&storageSuite{newStorage: func(c *gc.C) oostore.Storage {
+	return oostore.NewCompressedStorage(oostore.NewMemStorage(), 0)
+}})
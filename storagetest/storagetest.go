@@ -0,0 +1,318 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package storagetest provides a conformance test suite for oostore.Storage
+// implementations.
+//
+// To run it against a Storage implementation, embed StorageSuite in a gocheck
+// suite which sets Storage to a new, empty instance in SetUpTest:
+//
+//	type mySuite struct {
+//		storagetest.StorageSuite
+//	}
+//
+//	var _ = gc.Suite(&mySuite{})
+//
+//	func (s *mySuite) SetUpTest(c *gc.C) {
+//		s.Storage = newMyStorage()
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+// StorageSuite holds a Storage implementation to the contract expected of
+// it by oostore.
+type StorageSuite struct {
+	// Storage is the implementation under test. It must be set to a new,
+	// empty instance before each test.
+	Storage oostore.Storage
+}
+
+// TestRoundTrip checks that contents and content types are returned as they
+// were stored.
+func (s *StorageSuite) TestRoundTrip(c *gc.C) {
+	for i, testCase := range []struct {
+		id, contents, contentType string
+	}{
+		{"foo", "bar", "bar-ish"},
+		{"baz", "quux", "text/plain; charset=utf-8"},
+		{"json", `{"hello": "world"}`, "application/json"},
+	} {
+		comment := gc.Commentf("test#%d expect %#v", i, testCase)
+		c.Assert(s.Storage.Put(testCase.id, []byte(testCase.contents), testCase.contentType), gc.IsNil, comment)
+		contents, contentType, err := s.Storage.Get(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(string(contents), gc.Equals, testCase.contents, comment)
+		c.Assert(contentType, gc.Equals, testCase.contentType, comment)
+	}
+}
+
+// TestNotFound checks that missing objects are reported with
+// oostore.ErrNotFound.
+func (s *StorageSuite) TestNotFound(c *gc.C) {
+	_, _, err := s.Storage.Get("never-seen-it")
+	c.Assert(err, gc.Equals, oostore.ErrNotFound)
+	c.Assert(s.Storage.Delete("never-seen-it"), gc.Equals, oostore.ErrNotFound)
+}
+
+// TestDuplicatePut checks that an existing object is not replaced.
+func (s *StorageSuite) TestDuplicatePut(c *gc.C) {
+	c.Assert(s.Storage.Put("foo", []byte("bar"), "bar-ish"), gc.IsNil)
+	c.Assert(s.Storage.Put("foo", []byte("baz"), "baz-ish"), gc.NotNil)
+	contents, contentType, err := s.Storage.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "bar")
+	c.Assert(contentType, gc.Equals, "bar-ish")
+}
+
+// TestDelete checks that deleted objects are gone, and other objects are
+// not affected.
+func (s *StorageSuite) TestDelete(c *gc.C) {
+	c.Assert(s.Storage.Put("foo", []byte("bar"), "bar-ish"), gc.IsNil)
+	c.Assert(s.Storage.Put("baz", []byte("bar"), "bar-ish"), gc.IsNil)
+	c.Assert(s.Storage.Delete("foo"), gc.IsNil)
+	_, _, err := s.Storage.Get("foo")
+	c.Assert(err, gc.Equals, oostore.ErrNotFound)
+	c.Assert(s.Storage.Delete("foo"), gc.Equals, oostore.ErrNotFound)
+	contents, _, err := s.Storage.Get("baz")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "bar")
+
+	// A deleted ID may be used again.
+	c.Assert(s.Storage.Put("foo", []byte("again"), "again-ish"), gc.IsNil)
+	contents, contentType, err := s.Storage.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "again")
+	c.Assert(contentType, gc.Equals, "again-ish")
+}
+
+// TestEmpty checks that empty contents can be stored.
+func (s *StorageSuite) TestEmpty(c *gc.C) {
+	c.Assert(s.Storage.Put("empty", []byte{}, "text/plain"), gc.IsNil)
+	contents, contentType, err := s.Storage.Get("empty")
+	c.Assert(err, gc.IsNil)
+	c.Assert(contents, gc.HasLen, 0)
+	c.Assert(contentType, gc.Equals, "text/plain")
+}
+
+// TestLarge checks that large contents are stored intact.
+func (s *StorageSuite) TestLarge(c *gc.C) {
+	for i, large := range [][]byte{
+		randomBytes(c, 4<<20),
+		bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 100000),
+	} {
+		id := fmt.Sprintf("large%d", i)
+		c.Assert(s.Storage.Put(id, large, "text/plain"), gc.IsNil)
+		contents, _, err := s.Storage.Get(id)
+		c.Assert(err, gc.IsNil)
+		c.Assert(bytes.Equal(contents, large), gc.Equals, true, gc.Commentf("id %q", id))
+	}
+}
+
+// TestEncoded checks that implementations of oostore.EncodedStorage keep
+// the content encoding apart from the content type, return contents as
+// stored from GetEncoded, and decoded from Get.
+func (s *StorageSuite) TestEncoded(c *gc.C) {
+	es, ok := s.Storage.(oostore.EncodedStorage)
+	if !ok {
+		c.Skip("storage does not support content encodings")
+	}
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 10)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(text)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Close(), gc.IsNil)
+	c.Assert(es.PutEncoded("gzipped", buf.Bytes(), "text/plain", "gzip", "alice"), gc.IsNil)
+	c.Assert(es.PutEncoded("plain", text, "text/plain", "", "alice"), gc.IsNil)
+
+	for i, testCase := range []struct {
+		id, encoding string
+		stored       []byte
+	}{
+		{"gzipped", "gzip", buf.Bytes()},
+		{"plain", "", text},
+	} {
+		comment := gc.Commentf("test#%d: %s", i, testCase.id)
+		contents, contentType, encoding, err := es.GetEncoded(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(contents, gc.DeepEquals, testCase.stored, comment)
+		c.Assert(contentType, gc.Equals, "text/plain", comment)
+		c.Assert(encoding, gc.Equals, testCase.encoding, comment)
+		contents, contentType, err = es.Get(testCase.id)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(contents, gc.DeepEquals, text, comment)
+		c.Assert(contentType, gc.Equals, "text/plain", comment)
+	}
+	infos, err := es.List("alice", "", 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 2)
+	for _, info := range infos {
+		c.Assert(info.ContentType, gc.Equals, "text/plain")
+	}
+}
+
+// TestList checks that objects are listed by owner, in ID order.
+func (s *StorageSuite) TestList(c *gc.C) {
+	c.Assert(s.Storage.PutOwned("b", []byte("bb"), "b-ish", "alice"), gc.IsNil)
+	c.Assert(s.Storage.PutOwned("a", []byte("a"), "a-ish", "alice"), gc.IsNil)
+	c.Assert(s.Storage.PutOwned("c", []byte("ccc"), "c-ish", "alice"), gc.IsNil)
+	c.Assert(s.Storage.PutOwned("d", []byte("dddd"), "d-ish", "bob"), gc.IsNil)
+	c.Assert(s.Storage.Put("e", []byte("eeeee"), "e-ish"), gc.IsNil)
+	for i, testCase := range []struct {
+		owner, after string
+		limit        int
+		ids          []string
+	}{
+		{"alice", "", 10, []string{"a", "b", "c"}},
+		{"alice", "", 2, []string{"a", "b"}},
+		{"alice", "b", 2, []string{"c"}},
+		{"alice", "c", 2, nil},
+		{"bob", "", 10, []string{"d"}},
+		{"", "", 10, nil},
+		{"nobody", "", 10, nil},
+	} {
+		comment := gc.Commentf("test#%d expect list %#v", i, testCase)
+		infos, err := s.Storage.List(testCase.owner, testCase.after, testCase.limit)
+		c.Assert(err, gc.IsNil, comment)
+		var ids []string
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+			c.Assert(info.ContentType, gc.Equals, info.ID+"-ish", comment)
+			// Storage wrappers may report the size of contents as
+			// they are stored, rather than as given.
+			c.Assert(info.Size > 0, gc.Equals, true, comment)
+			c.Assert(info.Created.IsZero(), gc.Equals, false, comment)
+		}
+		c.Assert(ids, gc.DeepEquals, testCase.ids, comment)
+	}
+}
+
+// TestUsage checks that the usage of each owner, and the total, agree with
+// the sizes of the objects listed.
+func (s *StorageSuite) TestUsage(c *gc.C) {
+	s.assertUsage(c, map[string]int64{"": 0, "alice": 0})
+	c.Assert(s.Storage.PutOwned("a1", randomBytes(c, 100), "text/plain", "alice"), gc.IsNil)
+	c.Assert(s.Storage.PutOwned("a2", randomBytes(c, 200), "text/plain", "alice"), gc.IsNil)
+	c.Assert(s.Storage.PutOwned("b1", randomBytes(c, 300), "text/plain", "bob"), gc.IsNil)
+	alice := s.listedSize(c, "alice")
+	bob := s.listedSize(c, "bob")
+	c.Assert(alice > 0, gc.Equals, true)
+	c.Assert(bob > 0, gc.Equals, true)
+	s.assertUsage(c, map[string]int64{"": alice + bob, "alice": alice, "bob": bob, "nobody": 0})
+
+	// Objects without an owner only count toward the total.
+	c.Assert(s.Storage.Put("x", []byte("x"), "text/plain"), gc.IsNil)
+	total, err := s.Storage.Usage("")
+	c.Assert(err, gc.IsNil)
+	c.Assert(total > alice+bob, gc.Equals, true)
+	c.Assert(s.Storage.Delete("x"), gc.IsNil)
+
+	c.Assert(s.Storage.Delete("a1"), gc.IsNil)
+	alice = s.listedSize(c, "alice")
+	s.assertUsage(c, map[string]int64{"": alice + bob, "alice": alice, "bob": bob})
+	c.Assert(s.Storage.Delete("a2"), gc.IsNil)
+	c.Assert(s.Storage.Delete("b1"), gc.IsNil)
+	s.assertUsage(c, map[string]int64{"": 0, "alice": 0, "bob": 0})
+}
+
+func (s *StorageSuite) assertUsage(c *gc.C, expect map[string]int64) {
+	for owner, size := range expect {
+		usage, err := s.Storage.Usage(owner)
+		c.Assert(err, gc.IsNil)
+		c.Assert(usage, gc.Equals, size, gc.Commentf("owner %q", owner))
+	}
+}
+
+// listedSize returns the total size of the objects listed for owner.
+func (s *StorageSuite) listedSize(c *gc.C, owner string) int64 {
+	infos, err := s.Storage.List(owner, "", 1000)
+	c.Assert(err, gc.IsNil)
+	var total int64
+	for _, info := range infos {
+		total += info.Size
+	}
+	return total
+}
+
+// TestConcurrent checks that objects may be stored, fetched and deleted
+// concurrently.
+func (s *StorageSuite) TestConcurrent(c *gc.C) {
+	const workers, objects = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- s.exercise(w, objects)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Check(err, gc.IsNil)
+	}
+}
+
+// exercise stores, fetches and deletes objects, as one of several
+// concurrent workers. Workers share contents, which some implementations
+// store only once.
+func (s *StorageSuite) exercise(w, objects int) error {
+	for i := 0; i < objects; i++ {
+		id := fmt.Sprintf("worker%d-object%d", w, i)
+		want := fmt.Sprintf("contents%d", i)
+		if err := s.Storage.Put(id, []byte(want), "text/plain"); err != nil {
+			return fmt.Errorf("put %q: %v", id, err)
+		}
+		contents, _, err := s.Storage.Get(id)
+		if err != nil {
+			return fmt.Errorf("get %q: %v", id, err)
+		}
+		if string(contents) != want {
+			return fmt.Errorf("get %q: got %q, want %q", id, contents, want)
+		}
+		if i%2 == 0 {
+			if err := s.Storage.Delete(id); err != nil {
+				return fmt.Errorf("delete %q: %v", id, err)
+			}
+		}
+	}
+	for i := 1; i < objects; i += 2 {
+		id := fmt.Sprintf("worker%d-object%d", w, i)
+		if _, _, err := s.Storage.Get(id); err != nil {
+			return fmt.Errorf("get %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func randomBytes(c *gc.C, n int) []byte {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	c.Assert(err, gc.IsNil)
+	return buf
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Timezone data is embedded, so that time-window caveats naming a
+	// timezone can be checked on hosts without it installed.
+	_ "time/tzdata"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// condTimeWindow is the condition of caveats which restrict requests to
+// recurring windows of time, such as "Mon-Fri 09:00-17:00 America/Chicago".
+const condTimeWindow = "time-window"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a window of time which recurs on certain days of the week.
+type TimeWindow struct {
+	days       [7]bool
+	start, end int
+	loc        *time.Location
+}
+
+// ParseTimeWindow parses a time window of the form "days HH:MM-HH:MM
+// [timezone]". Days are a comma-separated list of days of the week and
+// ranges of them, such as "Mon-Fri" or "Sat,Sun". The window ends at the
+// second time, which may be "24:00". If it is not after the first, the
+// window runs past midnight into the following day. The timezone is an IANA
+// name such as "America/Chicago", and defaults to UTC.
+func ParseTimeWindow(s string) (*TimeWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errgo.Newf("invalid time window %q, expected days HH:MM-HH:MM [timezone]", s)
+	}
+	w := &TimeWindow{loc: time.UTC}
+	err := w.parseDays(fields[0])
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid time window %q", s)
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return nil, errgo.Newf("invalid time window %q, expected HH:MM-HH:MM", s)
+	}
+	if w.start, err = parseTimeOfDay(times[0]); err != nil || w.start == 24*60 {
+		return nil, errgo.Newf("invalid time window %q, bad start time %q", s, times[0])
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil || w.end == w.start {
+		return nil, errgo.Newf("invalid time window %q, bad end time %q", s, times[1])
+	}
+	if len(fields) == 3 {
+		w.loc, err = time.LoadLocation(fields[2])
+		if err != nil {
+			return nil, errgo.Newf("invalid time window %q, unknown timezone %q", s, fields[2])
+		}
+	}
+	return w, nil
+}
+
+func (w *TimeWindow) parseDays(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("bad days %q", part)
+		}
+		var days []time.Weekday
+		for _, bound := range bounds {
+			day, ok := weekdays[strings.ToLower(bound)]
+			if !ok {
+				return fmt.Errorf("unknown day %q", bound)
+			}
+			days = append(days, day)
+		}
+		// Ranges may wrap around the end of the week, as in Fri-Mon.
+		for day := days[0]; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == days[len(days)-1] {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay returns the minutes after midnight of a time given as
+// HH:MM, up to 24:00.
+func parseTimeOfDay(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil || len(s) != 5 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains returns whether t is within the time window. A window which runs
+// past midnight belongs to the day on which it starts.
+func (w *TimeWindow) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	mins := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && mins >= w.start && mins < w.end
+	}
+	if mins >= w.start {
+		return w.days[day]
+	}
+	return mins < w.end && w.days[(day+6)%7]
+}
+
+// timeWindowChecker checks that the current time on the server is within
+// the window given in a time-window caveat.
+var timeWindowChecker = checkers.CheckerFunc{
+	Condition_: condTimeWindow,
+	Check_: func(_, cav string) error {
+		w, err := ParseTimeWindow(cav)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !w.Contains(time.Now()) {
+			return fmt.Errorf("not within time window %q", cav)
+		}
+		return nil
+	},
+}
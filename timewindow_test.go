@@ -0,0 +1,86 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oostore_test
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/cmars/oostore"
+)
+
+type timeWindowSuite struct{}
+
+var _ = gc.Suite(&timeWindowSuite{})
+
+func (s *timeWindowSuite) TestContains(c *gc.C) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	c.Assert(err, gc.IsNil)
+	// 2015-10-21 is a Wednesday.
+	wed := func(hour, min int, loc *time.Location) time.Time {
+		return time.Date(2015, 10, 21, hour, min, 0, 0, loc)
+	}
+	for i, test := range []struct {
+		window string
+		t      time.Time
+		expect bool
+	}{
+		{"Mon-Fri 09:00-17:00 America/Chicago", wed(9, 0, chicago), true},
+		{"Mon-Fri 09:00-17:00 America/Chicago", wed(16, 59, chicago), true},
+		{"Mon-Fri 09:00-17:00 America/Chicago", wed(17, 0, chicago), false},
+		{"Mon-Fri 09:00-17:00 America/Chicago", wed(8, 59, chicago), false},
+		{"Mon-Fri 09:00-17:00 America/Chicago", wed(14, 0, time.UTC), true},
+		{"Mon-Fri 09:00-17:00", wed(14, 0, chicago), false},
+		{"Sat,Sun 00:00-24:00", wed(12, 0, time.UTC), false},
+		{"Sat,Sun 00:00-24:00", wed(12, 0, time.UTC).AddDate(0, 0, 3), true},
+		{"Fri-Mon 00:00-24:00", wed(12, 0, time.UTC).AddDate(0, 0, 5), true},
+		{"Fri-Mon 00:00-24:00", wed(12, 0, time.UTC).AddDate(0, 0, 6), false},
+		{"mon,wed 12:00-13:00", wed(12, 30, time.UTC), true},
+		// Windows past midnight belong to the day they start.
+		{"Wed 22:00-06:00", wed(23, 0, time.UTC), true},
+		{"Wed 22:00-06:00", wed(5, 0, time.UTC), false},
+		{"Wed 22:00-06:00", wed(5, 0, time.UTC).AddDate(0, 0, 1), true},
+		{"Wed 22:00-06:00", wed(6, 0, time.UTC).AddDate(0, 0, 1), false},
+	} {
+		comment := gc.Commentf("test#%d: %s at %v", i, test.window, test.t)
+		w, err := oostore.ParseTimeWindow(test.window)
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(w.Contains(test.t), gc.Equals, test.expect, comment)
+	}
+}
+
+func (s *timeWindowSuite) TestParseInvalid(c *gc.C) {
+	for i, test := range []struct {
+		window string
+		err    string
+	}{
+		{"Mon-Fri", `invalid time window "Mon-Fri", expected days HH:MM-HH:MM \[timezone\]`},
+		{"Mon-Fri 09:00-17:00 UTC extra", `invalid time window .*, expected days HH:MM-HH:MM \[timezone\]`},
+		{"Monday 09:00-17:00", `invalid time window .*: unknown day "Monday"`},
+		{"Mon-Wed-Fri 09:00-17:00", `invalid time window .*: bad days "Mon-Wed-Fri"`},
+		{"Mon 09:00", `invalid time window .*, expected HH:MM-HH:MM`},
+		{"Mon 9:00-17:00", `invalid time window .*, bad start time "9:00"`},
+		{"Mon 24:00-17:00", `invalid time window .*, bad start time "24:00"`},
+		{"Mon 09:00-17:60", `invalid time window .*, bad end time "17:60"`},
+		{"Mon 09:00-09:00", `invalid time window .*, bad end time "09:00"`},
+		{"Mon 09:00-17:00 Mars/Olympus_Mons", `invalid time window .*, unknown timezone "Mars/Olympus_Mons"`},
+	} {
+		_, err := oostore.ParseTimeWindow(test.window)
+		c.Assert(err, gc.ErrorMatches, test.err, gc.Commentf("test#%d: %s", i, test.window))
+	}
+}